@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/mpolden/atb/ratelimit"
+)
+
+// Keys is a set of API keys.
+type Keys struct {
+	keys    map[string]*Key
+	limiter *ratelimit.Limiter
+}
+
+// Key represents an API key assigned to a client.
+type Key struct {
+	Key      string  `json:"key"`
+	Name     string  `json:"name"`
+	Rate     float64 `json:"rate"`
+	Burst    int     `json:"burst"`
+	Disabled bool    `json:"disabled"`
+	Admin    bool    `json:"admin"`
+	limiter  *ratelimit.Limiter
+	usage    Usage
+	mu       sync.Mutex
+}
+
+// Usage contains usage counters for an API key.
+type Usage struct {
+	Name     string    `json:"name"`
+	Requests uint64    `json:"requests"`
+	Rejected uint64    `json:"rejected"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+type keyFile struct {
+	Keys []*Key `json:"keys"`
+}
+
+type contextKey struct{}
+
+// ReadFile reads API keys from the JSON file name.
+func ReadFile(name string) (*Keys, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return keys, nil
+}
+
+// Parse parses API keys from JSON data.
+func Parse(data []byte) (*Keys, error) {
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	keys := &Keys{keys: make(map[string]*Key, len(f.Keys))}
+	for i, k := range f.Keys {
+		if k.Rate > 0 && keys.limiter == nil {
+			// All keys share a limiter, with a bucket for each key name
+			keys.limiter = ratelimit.New(0, 1, time.Minute)
+		}
+		if k.Key == "" {
+			return nil, fmt.Errorf("keys[%d]: key is empty", i)
+		}
+		if k.Name == "" {
+			return nil, fmt.Errorf("keys[%d]: name is empty", i)
+		}
+		if _, ok := keys.keys[k.Key]; ok {
+			return nil, fmt.Errorf("keys[%d]: duplicate key for %s", i, k.Name)
+		}
+		if k.Rate > 0 {
+			k.limiter = keys.limiter
+		}
+		k.usage.Name = k.Name
+		keys.keys[k.Key] = k
+	}
+	return keys, nil
+}
+
+// Lookup returns the key matching s.
+func (k *Keys) Lookup(s string) (*Key, bool) {
+	key, ok := k.keys[s]
+	return key, ok
+}
+
+// Allow reports whether a request using this key is allowed now, and records its usage. Keys with a rate are limited by
+// name, so keys sharing a name share their limit. Keys without a rate are limited by fallback using client as key, unless
+// fallback is nil. If the request is not allowed, the returned duration is the time until the next request is allowed.
+func (k *Key) Allow(fallback *ratelimit.Limiter, client string) (bool, time.Duration) {
+	ok, wait := true, time.Duration(0)
+	if k.limiter != nil {
+		ok, wait = k.limiter.AllowRate(k.Name, k.Rate, k.Burst)
+	} else if fallback != nil {
+		ok, wait = fallback.Allow(client)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if ok {
+		k.usage.Requests++
+	} else {
+		k.usage.Rejected++
+	}
+	k.usage.LastUsed = time.Now()
+	return ok, wait
+}
+
+// Usage returns the current usage counters of this key.
+func (k *Key) Usage() Usage {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.usage
+}
+
+// NewContext returns a copy of ctx carrying key.
+func NewContext(ctx context.Context, key *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// FromContext returns the key carried by ctx, if any.
+func FromContext(ctx context.Context) (*Key, bool) {
+	key, ok := ctx.Value(contextKey{}).(*Key)
+	return key, ok
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mpolden/atb/ratelimit"
+)
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		in  string
+		err string
+	}{
+		{`{"keys":[{"key":"k1","name":"foo"},{"key":"k2","name":"bar","rate":1,"burst":1}]}`, ""},
+		{`{"keys":[{"name":"foo"}]}`, "keys[0]: key is empty"},
+		{`{"keys":[{"key":"k1","name":"foo"},{"key":"k2"}]}`, "keys[1]: name is empty"},
+		{`{"keys":[{"key":"k1","name":"foo"},{"key":"k1","name":"bar"}]}`, "keys[1]: duplicate key for bar"},
+	}
+	for i, tt := range tests {
+		_, err := Parse([]byte(tt.in))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("#%d: Parse(%q) = %q, want %q", i, tt.in, got, tt.err)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	keys, err := Parse([]byte(`{"keys":[{"key":"k1","name":"foo"},{"key":"k2","name":"bar","rate":1,"burst":2},{"key":"k3","name":"bar","rate":1,"burst":2}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys.Lookup("k4"); ok {
+		t.Errorf("Lookup(%q) succeeded, want failure", "k4")
+	}
+	fallback := ratelimit.New(1, 2, time.Hour)
+	var tests = []struct {
+		key      string
+		ok       bool
+		requests uint64
+		rejected uint64
+	}{
+		{"k1", true, 1, 0},
+		{"k1", true, 2, 0},
+		{"k1", false, 2, 1}, // Limited by fallback
+		{"k2", true, 1, 0},
+		{"k3", true, 1, 0},
+		{"k3", false, 1, 1}, // Shares limit with k2
+	}
+	for i, tt := range tests {
+		key, ok := keys.Lookup(tt.key)
+		if !ok {
+			t.Fatalf("#%d: Lookup(%q) failed", i, tt.key)
+		}
+		if ok, _ := key.Allow(fallback, "192.0.2.1"); ok != tt.ok {
+			t.Errorf("#%d: Allow() = %t, want %t", i, ok, tt.ok)
+		}
+		usage := key.Usage()
+		if usage.Requests != tt.requests || usage.Rejected != tt.rejected {
+			t.Errorf("#%d: Usage() = (%d, %d), want (%d, %d)", i, usage.Requests, usage.Rejected, tt.requests, tt.rejected)
+		}
+	}
+	key, _ := keys.Lookup("k1")
+	ctx := NewContext(context.Background(), key)
+	if got, ok := FromContext(ctx); !ok || got != key {
+		t.Errorf("FromContext() = (%v, %t), want (%v, %t)", got, ok, key, true)
+	}
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("FromContext() succeeded for empty context")
+	}
+}
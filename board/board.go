@@ -0,0 +1,201 @@
+package board
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Boards is a set of named departure boards, optionally persisted to a file.
+type Boards struct {
+	mu     sync.RWMutex
+	boards map[string]Board
+	file   string
+}
+
+// Board is a named set of stops whose departures are shown together.
+type Board struct {
+	Name  string `json:"name"`
+	Stops []Stop `json:"stops"`
+}
+
+// Stop is a stop on a board. Empty filters match all departures.
+type Stop struct {
+	// ID is the ID of the stop, e.g. 41613.
+	ID int `json:"id"`
+	// Direction only includes departures going in this direction, either inbound or outbound.
+	Direction string `json:"direction,omitempty"`
+	// Lines only includes departures on these lines, given as public codes.
+	Lines []string `json:"lines,omitempty"`
+}
+
+type boardFile struct {
+	Boards []Board `json:"boards"`
+}
+
+// ReadFile reads boards from the JSON file name. Changes to the returned boards are saved to the same file, which is
+// created if it does not exist.
+func ReadFile(name string) (*Boards, error) {
+	data, err := ioutil.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = []byte(`{}`), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	boards, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	boards.file = name
+	return boards, nil
+}
+
+// Parse parses boards from JSON data. Changes to the returned boards are kept in memory only.
+func Parse(data []byte) (*Boards, error) {
+	var f boardFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return New(f.Boards)
+}
+
+// New returns boards containing the given boards. Changes to the returned boards are kept in memory only.
+func New(bs []Board) (*Boards, error) {
+	boards := &Boards{boards: make(map[string]Board, len(bs))}
+	for i, b := range bs {
+		if err := b.Validate(); err != nil {
+			return nil, fmt.Errorf("boards[%d]: %w", i, err)
+		}
+		if _, ok := boards.boards[b.Name]; ok {
+			return nil, fmt.Errorf("boards[%d]: duplicate board %s", i, b.Name)
+		}
+		boards.boards[b.Name] = b
+	}
+	return boards, nil
+}
+
+// ValidName returns whether name is a valid board name. Names consist of lowercase letters, digits, dashes and
+// underscores.
+func ValidName(name string) bool { return namePattern.MatchString(name) }
+
+// Validate returns an error if b is invalid.
+func (b Board) Validate() error {
+	if !ValidName(b.Name) {
+		return fmt.Errorf("invalid name: %q", b.Name)
+	}
+	if len(b.Stops) == 0 {
+		return fmt.Errorf("%s: no stops", b.Name)
+	}
+	for i, s := range b.Stops {
+		if s.ID <= 0 {
+			return fmt.Errorf("%s: stops[%d]: invalid stop ID: %d", b.Name, i, s.ID)
+		}
+		switch s.Direction {
+		case "", "inbound", "outbound":
+		default:
+			return fmt.Errorf("%s: stops[%d]: invalid direction: %q", b.Name, i, s.Direction)
+		}
+		for _, line := range s.Lines {
+			if line == "" {
+				return fmt.Errorf("%s: stops[%d]: empty line", b.Name, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Get returns the board with given name.
+func (b *Boards) Get(name string) (Board, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	board, ok := b.boards[name]
+	return board, ok
+}
+
+// List returns all boards, sorted by name.
+func (b *Boards) List() []Board {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.sorted()
+}
+
+// sorted returns all boards, sorted by name. The caller must hold the lock.
+func (b *Boards) sorted() []Board {
+	boards := make([]Board, 0, len(b.boards))
+	for _, board := range b.boards {
+		boards = append(boards, board)
+	}
+	sort.Slice(boards, func(i, j int) bool { return boards[i].Name < boards[j].Name })
+	return boards
+}
+
+// Put creates or replaces the board with the name of board.
+func (b *Boards) Put(board Board) error {
+	if err := board.Validate(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, existed := b.boards[board.Name]
+	b.boards[board.Name] = board
+	if err := b.save(); err != nil {
+		if existed {
+			b.boards[board.Name] = old
+		} else {
+			delete(b.boards, board.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete deletes the board with given name, and returns whether it existed.
+func (b *Boards) Delete(name string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, ok := b.boards[name]
+	if !ok {
+		return false, nil
+	}
+	delete(b.boards, name)
+	if err := b.save(); err != nil {
+		b.boards[name] = old
+		return false, err
+	}
+	return true, nil
+}
+
+// save writes boards to the file they were read from, if any. The caller must hold the write lock.
+func (b *Boards) save() error {
+	if b.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(boardFile{Boards: b.sorted()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so that the file is never partially written
+	tmp, err := ioutil.TempFile(filepath.Dir(b.file), filepath.Base(b.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.file)
+}
@@ -0,0 +1,68 @@
+package board
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		in  string
+		err string
+	}{
+		{`{"boards":[{"name":"office","stops":[{"id":41613,"direction":"inbound"},{"id":42098,"lines":["21","3"]}]}]}`, ""},
+		{`{}`, ""},
+		{`{"boards":[{"name":"Office","stops":[{"id":41613}]}]}`, `boards[0]: invalid name: "Office"`},
+		{`{"boards":[{"name":"office"}]}`, "boards[0]: office: no stops"},
+		{`{"boards":[{"name":"office","stops":[{"id":0}]}]}`, "boards[0]: office: stops[0]: invalid stop ID: 0"},
+		{`{"boards":[{"name":"office","stops":[{"id":41613,"direction":"north"}]}]}`, `boards[0]: office: stops[0]: invalid direction: "north"`},
+		{`{"boards":[{"name":"office","stops":[{"id":41613,"lines":[""]}]}]}`, "boards[0]: office: stops[0]: empty line"},
+		{`{"boards":[{"name":"office","stops":[{"id":41613}]},{"name":"office","stops":[{"id":42098}]}]}`, "boards[1]: duplicate board office"},
+	}
+	for i, tt := range tests {
+		_, err := Parse([]byte(tt.in))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("#%d: Parse(%q) = %q, want %q", i, tt.in, got, tt.err)
+		}
+	}
+}
+
+func TestPersist(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "boards.json")
+	boards, err := ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	office := Board{Name: "office", Stops: []Stop{{ID: 41613, Direction: "inbound"}, {ID: 42098, Lines: []string{"21", "3"}}}}
+	home := Board{Name: "home", Stops: []Stop{{ID: 42029}}}
+	for _, b := range []Board{office, home} {
+		if err := boards.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := boards.Put(Board{Name: "home"}); err == nil {
+		t.Error("want error for invalid board")
+	}
+	if ok, err := boards.Delete("cabin"); ok || err != nil {
+		t.Errorf("Delete(%q) = %t, %v, want false, nil", "cabin", ok, err)
+	}
+	if ok, err := boards.Delete("home"); !ok || err != nil {
+		t.Errorf("Delete(%q) = %t, %v, want true, nil", "home", ok, err)
+	}
+
+	boards, err = ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []Board{office}, boards.List(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	if _, ok := boards.Get("home"); ok {
+		t.Error("want home to be deleted")
+	}
+}
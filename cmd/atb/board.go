@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// ANSI escape sequences used by the board.
+const (
+	ansiReset      = "\033[0m"
+	ansiBold       = "\033[1m"
+	ansiDim        = "\033[2m"
+	ansiRed        = "\033[31m"
+	ansiGreen      = "\033[32m"
+	ansiYellow     = "\033[33m"
+	ansiClear      = "\033[H\033[2J"
+	ansiHideCursor = "\033[?25l"
+	ansiShowCursor = "\033[?25h"
+)
+
+// boardStop is a stop shown on the board.
+type boardStop struct {
+	id         int
+	departures stopDepartures
+	err        error
+}
+
+// departureColour returns the colour of d relative to now.
+func departureColour(d departure, now time.Time) string {
+	switch {
+	case d.Cancelled:
+		return ansiRed
+	case d.Delayed:
+		return ansiYellow
+	case !d.Realtime:
+		return ansiDim
+	case d.DepartureTime.Sub(now) < time.Minute:
+		return ansiGreen
+	}
+	return ""
+}
+
+func pad(s string, width int) string {
+	return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+}
+
+// renderBoard writes a board showing up to limit departures from each stop. Colours are written if colour is true.
+func renderBoard(w io.Writer, stops []boardStop, now time.Time, limit int, colour bool) {
+	style := func(s, code string) string {
+		if !colour || code == "" {
+			return s
+		}
+		return code + s + ansiReset
+	}
+	// Align columns across all stops
+	lineWidth, destinationWidth := len("LINE"), len("DESTINATION")
+	for _, s := range stops {
+		for i, d := range s.departures.Departures {
+			if i == limit {
+				break
+			}
+			lineWidth = max(lineWidth, utf8.RuneCountInString(d.Line))
+			destinationWidth = max(destinationWidth, utf8.RuneCountInString(d.Destination))
+		}
+	}
+	fmt.Fprintln(w, style(now.Format("15:04:05"), ansiBold))
+	for _, s := range stops {
+		name := s.departures.Stop
+		if name == "" {
+			name = "Stop " + strconv.Itoa(s.id)
+		}
+		fmt.Fprintf(w, "\n%s\n", style(name, ansiBold))
+		if s.err != nil {
+			fmt.Fprintln(w, style("error: "+s.err.Error(), ansiRed))
+		}
+		if len(s.departures.Departures) == 0 {
+			if s.err == nil {
+				fmt.Fprintln(w, "Ingen avganger")
+			}
+			continue
+		}
+		fmt.Fprintln(w, style(pad("LINE", lineWidth)+"  "+pad("DESTINATION", destinationWidth)+"  DEPARTURE", ansiDim))
+		for i, d := range s.departures.Departures {
+			if i == limit {
+				break
+			}
+			row := pad(d.Line, lineWidth) + "  " + pad(d.Destination, destinationWidth) + "  " + departureText(d, now)
+			fmt.Fprintln(w, style(row, departureColour(d, now)))
+		}
+	}
+}
+
+func runBoard(args []string) {
+	fs := flag.NewFlagSet("board", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: atb board [flags] STOP-ID...\n\nShow a full-screen departure board for one or more stops.\n\n")
+		fs.PrintDefaults()
+	}
+	direction := fs.String("direction", "", "Only show departures going in this direction (inbound or outbound)")
+	line := fs.String("line", "", "Only show departures on this line, given as public code or line ID")
+	limit := fs.Int("limit", 8, "Maximum number of departures shown per stop")
+	refresh := fs.Duration("refresh", 30*time.Second, "Interval between fetching departures")
+	colour := fs.Bool("colour", os.Getenv("NO_COLOR") == "", "Use colours. Defaults to false if NO_COLOR is set")
+	server := fs.String("server", "", "Query the atb server at this URL instead of Entur. The API key is read from ATB_API_KEY")
+	configFile := fs.String("c", "", "Read Entur configuration from this JSON file")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	stops := make([]boardStop, 0, len(positional))
+	for _, arg := range positional {
+		stopID, err := strconv.Atoi(arg)
+		if err != nil {
+			log.Fatalf("invalid stop ID: %s", arg)
+		}
+		stops = append(stops, boardStop{id: stopID})
+	}
+	switch *direction {
+	case "", "inbound", "outbound":
+	default:
+		log.Fatalf("invalid direction: %s", *direction)
+	}
+	if *limit < 1 {
+		log.Fatalf("invalid limit: %d", *limit)
+	}
+	if *refresh < time.Second {
+		log.Fatalf("invalid refresh interval: %s", *refresh)
+	}
+	client, err := newDepartureClient(*server, *configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Print(ansiHideCursor)
+	defer fmt.Print(ansiShowCursor)
+	fetch := func() {
+		for i := range stops {
+			sd, err := client.departures(ctx, stops[i].id)
+			if err != nil {
+				// Keep showing the previous departures, if any
+				stops[i].err = err
+				continue
+			}
+			sd.Departures = filterDepartures(sd.Departures, *direction, *line)
+			stops[i].departures, stops[i].err = sd, nil
+		}
+	}
+	var buf bytes.Buffer
+	var fetched time.Time
+	// Redraw every second to keep countdowns current, but only fetch departures at the refresh interval
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if now.Sub(fetched) >= *refresh {
+			fetch()
+			fetched = now
+		}
+		buf.Reset()
+		buf.WriteString(ansiClear)
+		renderBoard(&buf, stops, time.Now(), *limit, *colour)
+		os.Stdout.Write(buf.Bytes())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRenderBoard(t *testing.T) {
+	now := time.Date(2022, 5, 20, 18, 0, 30, 0, time.FixedZone("CEST", 2*60*60))
+	stops := []boardStop{
+		{id: 41613, departures: stopDepartures{Stop: "Prinsens gate", Departures: []departure{
+			{Line: "3", Destination: "Hallset", DepartureTime: now.Add(30 * time.Second), Realtime: true},
+			{Line: "3", Destination: "Lohove", DepartureTime: now.Add(4 * time.Minute), Realtime: true, Delayed: true},
+			{Line: "11", Destination: "Risvollan", DepartureTime: now.Add(30 * time.Minute)},
+			{Line: "3", Destination: "Hallset", DepartureTime: now.Add(40 * time.Minute), Cancelled: true},
+		}}},
+		{id: 42098, departures: stopDepartures{Stop: "Studentersamfundet"}},
+		{id: 1, err: errors.New("stop not found")},
+	}
+	var tests = []struct {
+		limit  int
+		colour bool
+		out    string
+	}{
+		{3, false, `18:00:30
+
+Prinsens gate
+LINE  DESTINATION  DEPARTURE
+3     Hallset      nå
+3     Lohove       4 min
+11    Risvollan    ca. 18:30
+
+Studentersamfundet
+Ingen avganger
+
+Stop 1
+error: stop not found
+`},
+		{1, true, "\033[1m18:00:30\033[0m\n\n" +
+			"\033[1mPrinsens gate\033[0m\n" +
+			"\033[2mLINE  DESTINATION  DEPARTURE\033[0m\n" +
+			"\033[32m3     Hallset      nå\033[0m\n\n" +
+			"\033[1mStudentersamfundet\033[0m\n" +
+			"Ingen avganger\n\n" +
+			"\033[1mStop 1\033[0m\n" +
+			"\033[31merror: stop not found\033[0m\n"},
+	}
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		renderBoard(&buf, stops, now, tt.limit, tt.colour)
+		if got := buf.String(); got != tt.out {
+			t.Errorf("#%d: want\n%q\ngot\n%q", i, tt.out, got)
+		}
+	}
+	for _, tt := range []struct {
+		d    departure
+		want string
+	}{
+		{stops[0].departures.Departures[1], ansiYellow},
+		{stops[0].departures.Departures[2], ansiDim},
+		{stops[0].departures.Departures[3], ansiRed},
+		{departure{DepartureTime: now.Add(5 * time.Minute), Realtime: true}, ""},
+	} {
+		if got := departureColour(tt.d, now); got != tt.want {
+			t.Errorf("departureColour(%+v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
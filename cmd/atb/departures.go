@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mpolden/atb/config"
+	"github.com/mpolden/atb/entur"
+)
+
+// departure is a departure printed by the departures command.
+type departure struct {
+	Line          string    `json:"line"`
+	LineID        string    `json:"lineId"`
+	Destination   string    `json:"destination"`
+	Direction     string    `json:"direction"`
+	DepartureTime time.Time `json:"expectedDepartureTime"`
+	Realtime      bool      `json:"realtime"`
+	Delayed       bool      `json:"delayed"`
+	Cancelled     bool      `json:"cancelled"`
+}
+
+// stopDepartures are the departures from a stop.
+type stopDepartures struct {
+	Stop       string      `json:"stop"`
+	Departures []departure `json:"departures"`
+}
+
+// departureClient retrieves departures from a stop.
+type departureClient interface {
+	departures(ctx context.Context, stopID int) (stopDepartures, error)
+}
+
+// enturClient retrieves departures directly from Entur.
+type enturClient struct{ client *entur.Client }
+
+func (c enturClient) departures(ctx context.Context, stopID int) (stopDepartures, error) {
+	stop, err := c.client.Stop(ctx, stopID)
+	if err != nil {
+		return stopDepartures{}, err
+	}
+	enturDepartures, err := c.client.Departures(ctx, 25, stopID)
+	if err != nil {
+		return stopDepartures{}, err
+	}
+	departures := make([]departure, 0, len(enturDepartures))
+	for _, d := range enturDepartures {
+		direction := "outbound"
+		if d.Inbound {
+			direction = "inbound"
+		}
+		departures = append(departures, departure{
+			Line:          d.Line,
+			LineID:        d.LineID,
+			Destination:   d.Destination,
+			Direction:     direction,
+			DepartureTime: d.ScheduledDepartureTime,
+			Realtime:      d.IsRealtime,
+			Delayed:       d.Delayed(),
+			Cancelled:     d.IsCancelled,
+		})
+	}
+	return stopDepartures{Stop: stop.Name, Departures: departures}, nil
+}
+
+// serverClient retrieves departures from a running atb server.
+type serverClient struct{ url string }
+
+func (c serverClient) departures(ctx context.Context, stopID int) (stopDepartures, error) {
+	u := fmt.Sprintf("%s/api/v3/departures/%d", strings.TrimRight(c.url, "/"), stopID)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return stopDepartures{}, err
+	}
+	if key := os.Getenv("ATB_API_KEY"); key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return stopDepartures{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return stopDepartures{}, fmt.Errorf("%s: %d %s", u, resp.StatusCode, e.Message)
+	}
+	var r struct {
+		Stop struct {
+			Name string `json:"name"`
+		} `json:"stop"`
+		Departures []struct {
+			Line struct {
+				ID         string `json:"id"`
+				PublicCode string `json:"publicCode"`
+			} `json:"line"`
+			Destination           string    `json:"destination"`
+			Direction             string    `json:"direction"`
+			ExpectedDepartureTime time.Time `json:"expectedDepartureTime"`
+			Status                string    `json:"status"`
+		} `json:"departures"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return stopDepartures{}, err
+	}
+	departures := make([]departure, 0, len(r.Departures))
+	for _, d := range r.Departures {
+		departures = append(departures, departure{
+			Line:          d.Line.PublicCode,
+			LineID:        d.Line.ID,
+			Destination:   d.Destination,
+			Direction:     d.Direction,
+			DepartureTime: d.ExpectedDepartureTime,
+			Realtime:      d.Status != "scheduled",
+			Delayed:       d.Status == "delayed",
+			Cancelled:     d.Status == "cancelled",
+		})
+	}
+	return stopDepartures{Stop: r.Stop.Name, Departures: departures}, nil
+}
+
+// filterDepartures returns the departures in direction and on line. Empty values match all departures.
+func filterDepartures(departures []departure, direction, line string) []departure {
+	filtered := make([]departure, 0, len(departures))
+	for _, d := range departures {
+		if direction != "" && d.Direction != direction {
+			continue
+		}
+		if line != "" && d.Line != line && d.LineID != line {
+			continue
+		}
+		filtered = append(filtered, d)
+	}
+	return filtered
+}
+
+// departureText returns the departure time of d relative to now, formatted for display.
+func departureText(d departure, now time.Time) string {
+	if d.Cancelled {
+		return entur.CancelledDisplayTime
+	}
+	if !d.Realtime {
+		return "ca. " + entur.DisplayTime(d.DepartureTime, now)
+	}
+	return entur.DisplayTime(d.DepartureTime, now)
+}
+
+func writeDepartures(w io.Writer, sd stopDepartures, format string, now time.Time) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sd)
+	}
+	fmt.Fprintf(w, "%s, %s\n\n", sd.Stop, now.Format("15:04:05"))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tDESTINATION\tDEPARTURE")
+	for _, d := range sd.Departures {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", d.Line, d.Destination, departureText(d, now))
+	}
+	return tw.Flush()
+}
+
+// parseArgs parses flags in fs and returns the remaining positional arguments. Unlike fs.Parse, flags may follow
+// positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// newDepartureClient returns a client querying the atb server at serverURL, or Entur if serverURL is empty. Entur is
+// configured from the optional configFile and the environment.
+func newDepartureClient(serverURL, configFile string) (departureClient, error) {
+	if serverURL != "" {
+		if _, err := url.ParseRequestURI(serverURL); err != nil {
+			return nil, fmt.Errorf("invalid server url: %s", serverURL)
+		}
+		return serverClient{url: serverURL}, nil
+	}
+	cfg := config.Default()
+	if configFile != "" {
+		if err := cfg.ReadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	c := entur.New(cfg.Entur.URL)
+	c.ClientName = cfg.Entur.ClientName
+	c.Headers = cfg.Entur.Headers
+	c.Operators = cfg.Entur.Operators
+	return enturClient{client: c}, nil
+}
+
+func runDepartures(args []string) {
+	fs := flag.NewFlagSet("departures", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: atb departures [flags] STOP-ID\n\nList departures from a stop.\n\n")
+		fs.PrintDefaults()
+	}
+	direction := fs.String("direction", "", "Only list departures going in this direction (inbound or outbound)")
+	line := fs.String("line", "", "Only list departures on this line, given as public code or line ID")
+	format := fs.String("format", "text", "Output format (text or json)")
+	watch := fs.Duration("watch", 0, "Refresh departures at this interval, e.g. 30s")
+	server := fs.String("server", "", "Query the atb server at this URL instead of Entur. The API key is read from ATB_API_KEY")
+	configFile := fs.String("c", "", "Read Entur configuration from this JSON file")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	stopID, err := strconv.Atoi(positional[0])
+	if err != nil {
+		log.Fatalf("invalid stop ID: %s", positional[0])
+	}
+	switch *direction {
+	case "", "inbound", "outbound":
+	default:
+		log.Fatalf("invalid direction: %s", *direction)
+	}
+	if *format != "text" && *format != "json" {
+		log.Fatalf("invalid format: %s", *format)
+	}
+	client, err := newDepartureClient(*server, *configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for {
+		sd, err := client.departures(context.Background(), stopID)
+		if err != nil && *watch <= 0 {
+			log.Fatal(err)
+		}
+		if *watch > 0 && *format == "text" {
+			fmt.Print("\033[H\033[2J") // Clear screen
+		}
+		if err != nil {
+			// Keep watching as the error may be temporary
+			fmt.Fprintf(os.Stderr, "%s: %s\n", time.Now().Format("15:04:05"), err)
+		} else {
+			sd.Departures = filterDepartures(sd.Departures, *direction, *line)
+			if err := writeDepartures(os.Stdout, sd, *format, time.Now()); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *watch <= 0 {
+			return
+		}
+		time.Sleep(*watch)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	var tests = []struct {
+		args       []string
+		positional []string
+		direction  string
+		line       string
+	}{
+		{[]string{"41613"}, []string{"41613"}, "", ""},
+		{[]string{"41613", "--direction", "inbound", "--line", "3"}, []string{"41613"}, "inbound", "3"},
+		{[]string{"-direction=outbound", "41613", "-line", "3"}, []string{"41613"}, "outbound", "3"},
+	}
+	for i, tt := range tests {
+		fs := flag.NewFlagSet("departures", flag.ContinueOnError)
+		direction := fs.String("direction", "", "")
+		line := fs.String("line", "", "")
+		positional, err := parseArgs(fs, tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(positional, tt.positional) {
+			t.Errorf("#%d: want positional %q, got %q", i, tt.positional, positional)
+		}
+		if *direction != tt.direction {
+			t.Errorf("#%d: want direction %q, got %q", i, tt.direction, *direction)
+		}
+		if *line != tt.line {
+			t.Errorf("#%d: want line %q, got %q", i, tt.line, *line)
+		}
+	}
+}
+
+func TestServerDepartures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/departures/41613" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"status":404,"message":"Stop not found"}`)
+			return
+		}
+		fmt.Fprint(w, `{"stop":{"name":"Prinsens gate"},"departures":[
+{"line":{"id":"ATB:Line:2_3","publicCode":"3"},"destination":"Hallset","direction":"inbound","expectedDepartureTime":"2022-05-20T18:03:00+02:00","status":"onTime"},
+{"line":{"id":"ATB:Line:2_3","publicCode":"3"},"destination":"Lohove","direction":"outbound","expectedDepartureTime":"2022-05-20T18:05:00+02:00","status":"delayed"},
+{"line":{"id":"ATB:Line:2_11","publicCode":"11"},"destination":"Risvollan","direction":"inbound","expectedDepartureTime":"2022-05-20T18:30:00+02:00","status":"scheduled"},
+{"line":{"id":"ATB:Line:2_3","publicCode":"3"},"destination":"Hallset","direction":"inbound","expectedDepartureTime":"2022-05-20T18:40:00+02:00","status":"cancelled"}
+]}`)
+	}))
+	defer srv.Close()
+	client := serverClient{url: srv.URL + "/"}
+	if _, err := client.departures(context.Background(), 1); err == nil || err.Error() != srv.URL+"/api/v3/departures/1: 404 Stop not found" {
+		t.Errorf("want not found error, got %v", err)
+	}
+	sd, err := client.departures(context.Background(), 41613)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cest := time.FixedZone("CEST", 2*60*60)
+	want := []departure{
+		{Line: "3", LineID: "ATB:Line:2_3", Destination: "Hallset", Direction: "inbound", DepartureTime: time.Date(2022, 5, 20, 18, 3, 0, 0, cest), Realtime: true},
+		{Line: "3", LineID: "ATB:Line:2_3", Destination: "Lohove", Direction: "outbound", DepartureTime: time.Date(2022, 5, 20, 18, 5, 0, 0, cest), Realtime: true, Delayed: true},
+		{Line: "11", LineID: "ATB:Line:2_11", Destination: "Risvollan", Direction: "inbound", DepartureTime: time.Date(2022, 5, 20, 18, 30, 0, 0, cest)},
+		{Line: "3", LineID: "ATB:Line:2_3", Destination: "Hallset", Direction: "inbound", DepartureTime: time.Date(2022, 5, 20, 18, 40, 0, 0, cest), Realtime: true, Cancelled: true},
+	}
+	if len(sd.Departures) != len(want) {
+		t.Fatalf("want %d departures, got %d", len(want), len(sd.Departures))
+	}
+	for i, d := range sd.Departures {
+		if !d.DepartureTime.Equal(want[i].DepartureTime) {
+			t.Errorf("#%d: want departure time %s, got %s", i, want[i].DepartureTime, d.DepartureTime)
+		}
+		d.DepartureTime = want[i].DepartureTime
+		if !reflect.DeepEqual(d, want[i]) {
+			t.Errorf("#%d: want %+v, got %+v", i, want[i], d)
+		}
+	}
+	now := time.Date(2022, 5, 20, 18, 0, 30, 0, cest)
+	var tests = []struct {
+		direction string
+		line      string
+		out       string
+	}{
+		{"", "", `Prinsens gate, 18:00:30
+
+LINE  DESTINATION  DEPARTURE
+3     Hallset      2 min
+3     Lohove       4 min
+11    Risvollan    ca. 18:30
+3     Hallset      innstilt
+`},
+		{"inbound", "3", `Prinsens gate, 18:00:30
+
+LINE  DESTINATION  DEPARTURE
+3     Hallset      2 min
+3     Hallset      innstilt
+`},
+		{"", "ATB:Line:2_11", `Prinsens gate, 18:00:30
+
+LINE  DESTINATION  DEPARTURE
+11    Risvollan    ca. 18:30
+`},
+	}
+	for i, tt := range tests {
+		filtered := stopDepartures{Stop: sd.Stop, Departures: filterDepartures(sd.Departures, tt.direction, tt.line)}
+		var buf bytes.Buffer
+		if err := writeDepartures(&buf, filtered, "text", now); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.out {
+			t.Errorf("#%d: want\n%s\ngot\n%s", i, tt.out, got)
+		}
+	}
+}
@@ -1,12 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/mpolden/atb/auth"
+	"github.com/mpolden/atb/board"
+	"github.com/mpolden/atb/config"
+	"github.com/mpolden/atb/direction"
 	"github.com/mpolden/atb/entur"
 	"github.com/mpolden/atb/http"
+	"github.com/mpolden/atb/ratelimit"
+	"github.com/mpolden/atb/source"
+	"github.com/mpolden/atb/timetable"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 func init() {
@@ -22,18 +45,230 @@ func mustParseDuration(s string) time.Duration {
 	return d
 }
 
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func mustParseNetworks(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func parseStops(s string) ([]int, error) {
+	var stops []int
+	for _, v := range splitList(s) {
+		stopID, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, stopID)
+	}
+	return stops, nil
+}
+
+func mustSetLogger(format, level string) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		log.Fatal(err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		log.Fatalf("invalid log format: %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// mustSetTracer sets the global tracer provider and propagator. The returned provider must be shut down on exit to flush
+// buffered spans, and is nil if tracing is disabled.
+func mustSetTracer(exporter, endpoint string) *sdktrace.TracerProvider {
+	// Propagate trace context even when tracing is disabled, so that traces of other services are not broken
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var opt sdktrace.TracerProviderOption
+	switch exporter {
+	case "none":
+		return nil
+	case "stdout":
+		e, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			log.Fatal(err)
+		}
+		opt = sdktrace.WithSyncer(e)
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		e, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opt = sdktrace.WithBatcher(e)
+	default:
+		log.Fatalf("invalid trace exporter: %q", exporter)
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("atb"))
+	tp := sdktrace.NewTracerProvider(opt, sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp
+}
+
+// shutdownTracer shuts down tp, flushing any buffered spans.
+func shutdownTracer(tp *sdktrace.TracerProvider) {
+	if tp == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tp.Shutdown(ctx); err != nil {
+		slog.Error("failed to shut down tracer", "error", err)
+	}
+}
+
 func main() {
-	listen := flag.String("l", ":8080", "Listen address")
-	stopTTL := flag.String("s", "168h", "Bus stop cache duration")
-	departureTTL := flag.String("d", "1m", "Departure cache duration")
-	cors := flag.Bool("x", false, "Allow requests from other domains")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "departures":
+			runDepartures(os.Args[2:])
+			return
+		case "board":
+			runBoard(os.Args[2:])
+			return
+		}
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nCommands:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  board\n    \tShow a departure board for one or more stops. See %s board -h\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  departures\n    \tList departures from a stop. See %s departures -h\n", os.Args[0])
+	}
+	cfg := config.Default()
+	configFile := flag.String("c", "", "Read configuration from this JSON file. Flags take precedence over the file")
+	flag.StringVar(&cfg.Listen, "l", cfg.Listen, "Listen address")
+	flag.StringVar(&cfg.StopTTL, "s", cfg.StopTTL, "Bus stop cache duration")
+	flag.StringVar(&cfg.DepartureTTL, "d", cfg.DepartureTTL, "Departure cache duration")
+	flag.BoolVar(&cfg.CORS, "x", cfg.CORS, "Allow requests from other domains")
+	flag.Float64Var(&cfg.Rate, "r", cfg.Rate, "Requests per second allowed per client. 0 disables rate limiting")
+	flag.IntVar(&cfg.Burst, "b", cfg.Burst, "Maximum burst of requests allowed per client")
+	flag.Func("p", "Comma-separated networks of proxies trusted to set X-Forwarded-For", func(s string) error {
+		cfg.TrustedProxies = splitList(s)
+		return nil
+	})
+	flag.StringVar(&cfg.KeysFile, "k", cfg.KeysFile, "Require API keys read from this file")
+	flag.BoolVar(&cfg.Anonymous, "a", cfg.Anonymous, "Allow requests without API key when API keys are required")
+	flag.StringVar(&cfg.Log.Format, "o", cfg.Log.Format, "Log format (text or json)")
+	flag.StringVar(&cfg.Log.Level, "v", cfg.Log.Level, "Log level (debug, info, warn or error)")
+	flag.StringVar(&cfg.Trace.Exporter, "e", cfg.Trace.Exporter, "Trace exporter (none, stdout or otlp)")
+	flag.StringVar(&cfg.TimetableFile, "t", cfg.TimetableFile, "GTFS feed (zip file or directory) used for scheduled departures when Entur is unavailable")
+	flag.Func("g", "Comma-separated stop IDs to include in the GTFS-Realtime feed", func(s string) (err error) {
+		cfg.FeedStops, err = parseStops(s)
+		return err
+	})
+	flag.StringVar(&cfg.DirectionsFile, "i", cfg.DirectionsFile, "Classify departures as inbound or outbound using rules read from this file")
+	flag.StringVar(&cfg.BoardsFile, "f", cfg.BoardsFile, "Read named boards from this file. Boards changed through the API are saved to it")
+	flag.StringVar(&cfg.Entur.URL, "j", cfg.Entur.URL, "Entur Journey Planner API URL")
+	flag.StringVar(&cfg.Entur.ClientName, "n", cfg.Entur.ClientName, "Client name identifying this deployment to Entur")
+	flag.Func("H", "Extra header sent to Entur, as \"Name: Value\". May be repeated", cfg.Entur.SetHeader)
+	flag.StringVar(&cfg.Trace.Endpoint, "u", cfg.Trace.Endpoint, "OTLP endpoint URL for traces. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318")
+	flag.Parse()
+	if *configFile != "" {
+		if err := cfg.ReadFile(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	// Parse flags again as flags given on the command line override the config file and environment
 	flag.Parse()
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
 
-	entur := entur.New("")
-	server := http.New(entur, mustParseDuration(*stopTTL), mustParseDuration(*departureTTL), *cors)
+	mustSetLogger(cfg.Log.Format, cfg.Log.Level)
+	tp := mustSetTracer(cfg.Trace.Exporter, cfg.Trace.Endpoint)
+
+	enturClient := entur.New(cfg.Entur.URL)
+	enturClient.VehiclesURL = cfg.Entur.VehiclesURL
+	enturClient.ClientName = cfg.Entur.ClientName
+	enturClient.Headers = cfg.Entur.Headers
+	enturClient.Operators = cfg.Entur.Operators
+	var src source.DepartureSource = enturClient
+	if cfg.TimetableFile != "" {
+		tab, err := timetable.ReadFile(cfg.TimetableFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src = source.NewComposite(src, tab)
+	}
+	server := http.New(src, mustParseDuration(cfg.StopTTL), mustParseDuration(cfg.DepartureTTL), cfg.CORS)
+	server.Planner = enturClient
+	server.Lines = enturClient
+	server.Vehicles = enturClient
+	if cfg.Rate > 0 {
+		server.RateLimiter = ratelimit.New(cfg.Rate, cfg.Burst, time.Minute)
+	}
+	server.TrustedProxies = mustParseNetworks(cfg.TrustedProxies)
+	server.FeedStops = cfg.FeedStops
+	if cfg.KeysFile != "" {
+		keys, err := auth.ReadFile(cfg.KeysFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Keys = keys
+		server.Anonymous = cfg.Anonymous
+	}
+	if cfg.DirectionsFile != "" {
+		rules, err := direction.ReadFile(cfg.DirectionsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Directions = rules
+	}
+	if cfg.BoardsFile != "" {
+		boards, err := board.ReadFile(cfg.BoardsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Boards = boards
+	} else if len(cfg.Boards) > 0 {
+		boards, err := board.New(cfg.Boards)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Boards = boards
+	}
 
-	log.Printf("Listening on %s", *listen)
-	if err := server.ListenAndServe(*listen); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- server.ListenAndServe(cfg.Listen) }()
+	slog.Info("listening", "addr", cfg.Listen)
+	select {
+	case err := <-errc:
+		shutdownTracer(tp)
 		log.Fatal(err)
+	case <-ctx.Done():
+		slog.Info("shutting down")
+		shutdownTracer(tp)
 	}
 }
@@ -0,0 +1,367 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpolden/atb/board"
+	"github.com/mpolden/atb/entur"
+)
+
+// Config contains the configuration of the atb server.
+type Config struct {
+	Listen         string   `json:"listen"`
+	CORS           bool     `json:"cors"`
+	StopTTL        string   `json:"stopTTL"`
+	DepartureTTL   string   `json:"departureTTL"`
+	Entur          Entur    `json:"entur"`
+	Rate           float64  `json:"rate"`
+	Burst          int      `json:"burst"`
+	TrustedProxies []string `json:"trustedProxies"`
+	KeysFile       string   `json:"keysFile"`
+	Anonymous      bool     `json:"anonymous"`
+	Log            Log      `json:"log"`
+	Trace          Trace    `json:"trace"`
+	TimetableFile  string   `json:"timetableFile"`
+	DirectionsFile string   `json:"directionsFile"`
+	BoardsFile     string   `json:"boardsFile"`
+	// Boards contains named boards defined in the configuration. Changes made through the API are not persisted, so
+	// use BoardsFile instead to manage boards through the API.
+	Boards    []board.Board `json:"boards"`
+	FeedStops []int         `json:"feedStops"`
+}
+
+// Entur contains the configuration of the Entur client.
+type Entur struct {
+	URL         string            `json:"url"`
+	VehiclesURL string            `json:"vehiclesUrl"`
+	ClientName  string            `json:"clientName"`
+	Headers     map[string]string `json:"headers"`
+	Operators   []string          `json:"operators"`
+}
+
+// Log contains the logging configuration.
+type Log struct {
+	Format string `json:"format"`
+	Level  string `json:"level"`
+}
+
+// Trace contains the tracing configuration.
+type Trace struct {
+	Exporter string `json:"exporter"`
+	Endpoint string `json:"endpoint"`
+}
+
+// Default returns the default configuration.
+func Default() Config {
+	return Config{
+		Listen:       ":8080",
+		StopTTL:      "168h",
+		DepartureTTL: "1m",
+		Entur: Entur{
+			URL:         entur.DefaultURL,
+			VehiclesURL: entur.DefaultVehiclesURL,
+			ClientName:  entur.DefaultClientName,
+			Operators:   append([]string(nil), entur.DefaultOperators...),
+		},
+		Burst: 10,
+		Log:   Log{Format: "text", Level: "info"},
+		Trace: Trace{Exporter: "none"},
+	}
+}
+
+// ReadFile reads configuration from the JSON file name into c. Keys missing from the file keep their current value.
+func (c *Config) ReadFile(name string) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := c.Parse(data); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// Parse parses configuration from JSON data into c. Keys missing from data keep their current value.
+func (c *Config) Parse(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%s: want %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			if key := unknownKey(data, reflect.TypeOf(c).Elem(), ""); key != "" {
+				return fmt.Errorf("unknown key %q", key)
+			}
+			return fmt.Errorf("unknown key %s", field)
+		}
+		return err
+	}
+	return nil
+}
+
+// unknownKey returns the path of the first key in data, e.g. entur.clientName, that has no matching field in type t. It
+// returns an empty string if all keys are known.
+func unknownKey(data []byte, t reflect.Type, path string) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return ""
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			keyPath := k
+			if path != "" {
+				keyPath = path + "." + k
+			}
+			field, ok := jsonField(t, k)
+			if !ok {
+				return keyPath
+			}
+			if key := unknownKey(obj[k], field.Type, keyPath); key != "" {
+				return key
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return ""
+		}
+		for i, elem := range elems {
+			if key := unknownKey(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); key != "" {
+				return key
+			}
+		}
+	}
+	return ""
+}
+
+// jsonField returns the field of struct type t that is decoded from given JSON key. Like encoding/json, keys are
+// matched case-insensitively.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ParseHeader parses a header given as "Name: Value".
+func ParseHeader(s string) (string, string, error) {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid header %q", s)
+	}
+	return name, strings.TrimSpace(value), nil
+}
+
+// SetHeader sets the header given as "Name: Value" in the Entur configuration.
+func (e *Entur) SetHeader(s string) error {
+	name, value, err := ParseHeader(s)
+	if err != nil {
+		return err
+	}
+	if e.Headers == nil {
+		e.Headers = make(map[string]string)
+	}
+	e.Headers[name] = value
+	return nil
+}
+
+func parseInts(s string) ([]int, error) {
+	var ints []int
+	for _, v := range splitList(s) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// envVar is an environment variable overriding a configuration key.
+type envVar struct {
+	name string
+	key  string
+	set  func(string) error
+}
+
+// env returns the environment variables that override keys of c.
+func (c *Config) env() []envVar {
+	str := func(dst *string) func(string) error { return func(v string) error { *dst = v; return nil } }
+	list := func(dst *[]string) func(string) error {
+		return func(v string) error { *dst = splitList(v); return nil }
+	}
+	boolean := func(dst *bool) func(string) error {
+		return func(v string) (err error) { *dst, err = strconv.ParseBool(v); return err }
+	}
+	return []envVar{
+		{"ATB_LISTEN", "listen", str(&c.Listen)},
+		{"ATB_CORS", "cors", boolean(&c.CORS)},
+		{"ATB_STOP_TTL", "stopTTL", str(&c.StopTTL)},
+		{"ATB_DEPARTURE_TTL", "departureTTL", str(&c.DepartureTTL)},
+		{"ATB_ENTUR_URL", "entur.url", str(&c.Entur.URL)},
+		{"ATB_ENTUR_VEHICLES_URL", "entur.vehiclesUrl", str(&c.Entur.VehiclesURL)},
+		{"ATB_ENTUR_CLIENT_NAME", "entur.clientName", str(&c.Entur.ClientName)},
+		{"ATB_ENTUR_HEADERS", "entur.headers", func(v string) error {
+			for _, h := range splitList(v) {
+				if err := c.Entur.SetHeader(h); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"ATB_ENTUR_OPERATORS", "entur.operators", list(&c.Entur.Operators)},
+		{"ATB_RATE", "rate", func(v string) (err error) { c.Rate, err = strconv.ParseFloat(v, 64); return err }},
+		{"ATB_BURST", "burst", func(v string) (err error) { c.Burst, err = strconv.Atoi(v); return err }},
+		{"ATB_TRUSTED_PROXIES", "trustedProxies", list(&c.TrustedProxies)},
+		{"ATB_KEYS_FILE", "keysFile", str(&c.KeysFile)},
+		{"ATB_ANONYMOUS", "anonymous", boolean(&c.Anonymous)},
+		{"ATB_LOG_FORMAT", "log.format", str(&c.Log.Format)},
+		{"ATB_LOG_LEVEL", "log.level", str(&c.Log.Level)},
+		{"ATB_TRACE_EXPORTER", "trace.exporter", str(&c.Trace.Exporter)},
+		{"ATB_TRACE_ENDPOINT", "trace.endpoint", str(&c.Trace.Endpoint)},
+		{"ATB_TIMETABLE_FILE", "timetableFile", str(&c.TimetableFile)},
+		{"ATB_DIRECTIONS_FILE", "directionsFile", str(&c.DirectionsFile)},
+		{"ATB_BOARDS_FILE", "boardsFile", str(&c.BoardsFile)},
+		{"ATB_FEED_STOPS", "feedStops", func(v string) (err error) { c.FeedStops, err = parseInts(v); return err }},
+	}
+}
+
+// ApplyEnv overrides configuration keys with environment variables found by lookup, e.g. ATB_LISTEN overrides listen.
+func (c *Config) ApplyEnv(lookup func(string) (string, bool)) error {
+	for _, e := range c.env() {
+		v, ok := lookup(e.name)
+		if !ok {
+			continue
+		}
+		if err := e.set(v); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s", e.name, v, e.key)
+		}
+	}
+	return nil
+}
+
+// Validate returns an error naming the first invalid key in c, if any.
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("listen: must be set")
+	}
+	if _, err := time.ParseDuration(c.StopTTL); err != nil {
+		return fmt.Errorf("stopTTL: invalid duration %q", c.StopTTL)
+	}
+	if _, err := time.ParseDuration(c.DepartureTTL); err != nil {
+		return fmt.Errorf("departureTTL: invalid duration %q", c.DepartureTTL)
+	}
+	if u, err := url.Parse(c.Entur.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("entur.url: invalid url %q", c.Entur.URL)
+	}
+	if u, err := url.Parse(c.Entur.VehiclesURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("entur.vehiclesUrl: invalid url %q", c.Entur.VehiclesURL)
+	}
+	if c.Entur.ClientName == "" {
+		return fmt.Errorf("entur.clientName: must be set")
+	}
+	names := make([]string, 0, len(c.Entur.Headers))
+	for name := range c.Entur.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch {
+		case name == "" || strings.ContainsAny(name, " :\t\r\n"):
+			return fmt.Errorf("entur.headers: invalid header name %q", name)
+		case http.CanonicalHeaderKey(name) == "Et-Client-Name":
+			return fmt.Errorf("entur.headers: use entur.clientName to set %s", name)
+		case http.CanonicalHeaderKey(name) == "Content-Type":
+			return fmt.Errorf("entur.headers: %s cannot be overridden", name)
+		}
+	}
+	for i, op := range c.Entur.Operators {
+		if op == "" {
+			return fmt.Errorf("entur.operators[%d]: must not be empty", i)
+		}
+	}
+	if c.Rate < 0 {
+		return fmt.Errorf("rate: must be zero or positive, got %g", c.Rate)
+	}
+	if c.Rate > 0 && c.Burst < 1 {
+		return fmt.Errorf("burst: must be positive when rate is set, got %d", c.Burst)
+	}
+	for i, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("trustedProxies[%d]: invalid network %q", i, cidr)
+		}
+	}
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("log.format: must be text or json, got %q", c.Log.Format)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		return fmt.Errorf("log.level: must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	switch c.Trace.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		return fmt.Errorf("trace.exporter: must be none, stdout or otlp, got %q", c.Trace.Exporter)
+	}
+	if len(c.Boards) > 0 {
+		if c.BoardsFile != "" {
+			return fmt.Errorf("boards: cannot be combined with boardsFile")
+		}
+		if _, err := board.New(c.Boards); err != nil {
+			return err
+		}
+	}
+	for i, stopID := range c.FeedStops {
+		if stopID <= 0 {
+			return fmt.Errorf("feedStops[%d]: invalid stop ID %d", i, stopID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		in  string
+		err string
+	}{
+		{`{}`, ""},
+		{`{"listen":":9090","entur":{"clientName":"example-board","operators":["ATB:","SKY:"]},"rate":1,"trustedProxies":["127.0.0.1/32"],"feedStops":[41613]}`, ""},
+		{`{"lsiten":":9090"}`, `unknown key "lsiten"`},
+		{`{"entur":{"client":"foo"}}`, `unknown key "entur.client"`},
+		{`{"log":{"level":"info","colour":true}}`, `unknown key "log.colour"`},
+		{`{"boards":[{"name":"office","stops":[{"id":41613}]},{"name":"home","stops":[{"id":42098,"line":"3"}]}]}`, `unknown key "boards[1].stops[0].line"`},
+		{`{"entur":{"clientName":1}}`, "entur.clientName: want string, got number"},
+		{`{"burst":"10"}`, "burst: want int, got string"},
+		{`{"entur":{"operators":"ATB:"}}`, "entur.operators: want []string, got string"},
+		{`{"listen":"","stopTTL":"1m"}`, "listen: must be set"},
+		{`{"stopTTL":"1x"}`, `stopTTL: invalid duration "1x"`},
+		{`{"departureTTL":""}`, `departureTTL: invalid duration ""`},
+		{`{"entur":{"url":"api.entur.io"}}`, `entur.url: invalid url "api.entur.io"`},
+		{`{"entur":{"operators":["ATB:",""]}}`, "entur.operators[1]: must not be empty"},
+		{`{"entur":{"vehiclesUrl":""}}`, `entur.vehiclesUrl: invalid url ""`},
+		{`{"entur":{"clientName":""}}`, "entur.clientName: must be set"},
+		{`{"entur":{"headers":{"X-Api-Key":"s3cret"}}}`, ""},
+		{`{"entur":{"headers":{"X Api Key":"s3cret"}}}`, `entur.headers: invalid header name "X Api Key"`},
+		{`{"entur":{"headers":{"et-client-name":"foo"}}}`, "entur.headers: use entur.clientName to set et-client-name"},
+		{`{"entur":{"headers":{"Content-Type":"text/plain"}}}`, "entur.headers: Content-Type cannot be overridden"},
+		{`{"rate":-1}`, "rate: must be zero or positive, got -1"},
+		{`{"rate":1,"burst":0}`, "burst: must be positive when rate is set, got 0"},
+		{`{"trustedProxies":["127.0.0.1/32","foo"]}`, `trustedProxies[1]: invalid network "foo"`},
+		{`{"log":{"format":"xml"}}`, `log.format: must be text or json, got "xml"`},
+		{`{"log":{"level":"verbose"}}`, `log.level: must be debug, info, warn or error, got "verbose"`},
+		{`{"trace":{"exporter":"jaeger"}}`, `trace.exporter: must be none, stdout or otlp, got "jaeger"`},
+		{`{"feedStops":[41613,0]}`, "feedStops[1]: invalid stop ID 0"},
+		{`{"boards":[{"name":"office","stops":[{"id":41613,"direction":"inbound"}]}]}`, ""},
+		{`{"boards":[{"name":"office","stops":[{"id":0}]}]}`, "boards[0]: office: stops[0]: invalid stop ID: 0"},
+		{`{"boardsFile":"boards.json","boards":[{"name":"office","stops":[{"id":41613}]}]}`, "boards: cannot be combined with boardsFile"},
+	}
+	for i, tt := range tests {
+		c := Default()
+		err := c.Parse([]byte(tt.in))
+		if err == nil {
+			err = c.Validate()
+		}
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("#%d: Parse(%q) = %q, want %q", i, tt.in, got, tt.err)
+		}
+	}
+}
+
+func TestParseKeepsDefaults(t *testing.T) {
+	c := Default()
+	if err := c.Parse([]byte(`{"listen":":9090","entur":{"clientName":"example-board"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.Listen = ":9090"
+	want.Entur.ClientName = "example-board"
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("want %+v, got %+v", want, c)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "atb.json")
+	if err := os.WriteFile(name, []byte(`{"entur":{"clientName":"example-board","operator":["ATB:"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := Default()
+	want := name + `: unknown key "entur.operator"`
+	if err := c.ReadFile(name); err == nil || err.Error() != want {
+		t.Errorf("want error %q, got %v", want, err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"ATB_LISTEN":          ":9090",
+		"ATB_CORS":            "true",
+		"ATB_ENTUR_OPERATORS": "ATB:, SKY:",
+		"ATB_ENTUR_HEADERS":   "X-Api-Key: s3cret,X-Deployment:board",
+		"ATB_RATE":            "2.5",
+		"ATB_FEED_STOPS":      "41613,42098",
+		"ATB_BOARDS_FILE":     "/var/lib/atb/boards.json",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	c := Default()
+	if err := c.ApplyEnv(lookup); err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.Listen = ":9090"
+	want.CORS = true
+	want.Entur.Operators = []string{"ATB:", "SKY:"}
+	want.Entur.Headers = map[string]string{"X-Api-Key": "s3cret", "X-Deployment": "board"}
+	want.Rate = 2.5
+	want.FeedStops = []int{41613, 42098}
+	want.BoardsFile = "/var/lib/atb/boards.json"
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("want %+v, got %+v", want, c)
+	}
+
+	env = map[string]string{"ATB_ENTUR_HEADERS": "X-Api-Key"}
+	if err := c.ApplyEnv(lookup); err == nil || err.Error() != `ATB_ENTUR_HEADERS: invalid value "X-Api-Key" for entur.headers` {
+		t.Errorf("want error for ATB_ENTUR_HEADERS, got %v", err)
+	}
+	env = map[string]string{"ATB_BURST": "ten"}
+	if err := c.ApplyEnv(lookup); err == nil || err.Error() != `ATB_BURST: invalid value "ten" for burst` {
+		t.Errorf("want error for ATB_BURST, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package direction
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mpolden/atb/entur"
+)
+
+const (
+	inbound  = "inbound"
+	outbound = "outbound"
+)
+
+// Rules classifies departures as going towards (inbound) or away from (outbound) the city centre.
+type Rules struct {
+	rules       []Rule
+	centreStops map[string]bool
+}
+
+// Rule sets the direction of departures matching all non-empty fields of the rule.
+type Rule struct {
+	// Line is the public code or ID of the line.
+	Line string `json:"line"`
+	// Destination is the destination shown on the vehicle. Matching is case-insensitive.
+	Destination string `json:"destination"`
+	// Quay is the ID of the quay the departure leaves from.
+	Quay string `json:"quay"`
+	// Direction is the direction of matching departures, either inbound or outbound.
+	Direction string `json:"direction"`
+}
+
+type ruleFile struct {
+	Rules []Rule `json:"rules"`
+	// CentreStops contains stop IDs in the city centre. A departure not matching any rule is inbound if any of the
+	// remaining stops of its journey is a centre stop.
+	CentreStops []int `json:"centreStops"`
+}
+
+// ReadFile reads rules from the JSON file name.
+func ReadFile(name string) (*Rules, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return rules, nil
+}
+
+// Parse parses rules from JSON data.
+func Parse(data []byte) (*Rules, error) {
+	var f ruleFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for i, r := range f.Rules {
+		if r.Line == "" && r.Destination == "" && r.Quay == "" {
+			return nil, fmt.Errorf("rules[%d]: line, destination or quay must be set", i)
+		}
+		if r.Direction != inbound && r.Direction != outbound {
+			return nil, fmt.Errorf("rules[%d]: invalid direction: %q", i, r.Direction)
+		}
+	}
+	centreStops := make(map[string]bool, len(f.CentreStops))
+	for _, stopID := range f.CentreStops {
+		centreStops[fmt.Sprintf("NSR:StopPlace:%d", stopID)] = true
+	}
+	return &Rules{rules: f.Rules, centreStops: centreStops}, nil
+}
+
+func (r Rule) matches(d entur.Departure) bool {
+	if r.Line != "" && r.Line != d.Line && r.Line != d.LineID {
+		return false
+	}
+	if r.Destination != "" && !strings.EqualFold(r.Destination, d.Destination) {
+		return false
+	}
+	if r.Quay != "" && r.Quay != d.Quay {
+		return false
+	}
+	return true
+}
+
+// Inbound returns whether departure d is going towards the city centre. Rules are evaluated in order and the first
+// matching rule decides the direction. If no rule matches and centre stops are configured, calls is used to retrieve
+// the calls of the journey of d. If neither decides the direction, the direction given by Entur is used.
+func (r *Rules) Inbound(d entur.Departure, calls func() ([]entur.Call, error)) bool {
+	for _, rule := range r.rules {
+		if rule.matches(d) {
+			return rule.Direction == inbound
+		}
+	}
+	if len(r.centreStops) > 0 && calls != nil {
+		if cs, err := calls(); err == nil {
+			if inbound, ok := r.towardsCentre(d, cs); ok {
+				return inbound
+			}
+		}
+	}
+	return d.Inbound
+}
+
+// towardsCentre returns whether any of the calls following the call of departure d is at a centre stop. The second
+// return value is false if the call of d cannot be found.
+func (r *Rules) towardsCentre(d entur.Departure, calls []entur.Call) (bool, bool) {
+	for i, c := range calls {
+		if c.Quay != d.Quay {
+			continue
+		}
+		for _, next := range calls[i+1:] {
+			if r.centreStops[next.StopPlace] {
+				return true, true
+			}
+		}
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,78 @@
+package direction
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mpolden/atb/entur"
+)
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		in  string
+		err string
+	}{
+		{`{"rules":[{"line":"3","destination":"Hallset","direction":"inbound"},{"quay":"NSR:Quay:71184","direction":"outbound"}],"centreStops":[41613]}`, ""},
+		{`{"centreStops":[41613]}`, ""},
+		{`{"rules":[{"direction":"inbound"}]}`, "rules[0]: line, destination or quay must be set"},
+		{`{"rules":[{"line":"3","direction":"inbound"},{"line":"3"}]}`, `rules[1]: invalid direction: ""`},
+		{`{"rules":[{"line":"3","direction":"north"}]}`, `rules[0]: invalid direction: "north"`},
+	}
+	for i, tt := range tests {
+		_, err := Parse([]byte(tt.in))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("#%d: Parse(%q) = %q, want %q", i, tt.in, got, tt.err)
+		}
+	}
+}
+
+func TestInbound(t *testing.T) {
+	rules, err := Parse([]byte(`{
+  "rules": [
+    {"quay": "NSR:Quay:71184", "direction": "outbound"},
+    {"line": "3", "destination": "hallset", "direction": "inbound"},
+    {"line": "ATB:Line:2_11", "direction": "outbound"}
+  ],
+  "centreStops": [41613]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []entur.Call{
+		{StopPlace: "NSR:StopPlace:42098", Quay: "NSR:Quay:73154"},
+		{StopPlace: "NSR:StopPlace:41613", Quay: "NSR:Quay:71181"},
+		{StopPlace: "NSR:StopPlace:44085", Quay: "NSR:Quay:75705"},
+	}
+	journey := func() ([]entur.Call, error) { return calls, nil }
+	failing := func() ([]entur.Call, error) { return nil, fmt.Errorf("failed") }
+	var tests = []struct {
+		departure entur.Departure
+		calls     func() ([]entur.Call, error)
+		inbound   bool
+	}{
+		// Quay rule takes precedence
+		{entur.Departure{Line: "3", Destination: "Hallset", Quay: "NSR:Quay:71184"}, journey, false},
+		// Line and destination rule
+		{entur.Departure{Line: "3", Destination: "Hallset", Quay: "NSR:Quay:73154"}, journey, true},
+		// Line ID rule
+		{entur.Departure{Line: "11", LineID: "ATB:Line:2_11", Quay: "NSR:Quay:73154", Inbound: true}, journey, false},
+		// Centre stop is among remaining stops
+		{entur.Departure{Line: "21", Quay: "NSR:Quay:73154"}, journey, true},
+		// Centre stop is already passed
+		{entur.Departure{Line: "21", Quay: "NSR:Quay:75705", Inbound: true}, journey, false},
+		// Departure is not part of the journey
+		{entur.Departure{Line: "21", Quay: "NSR:Quay:1", Inbound: true}, journey, true},
+		// Journey cannot be retrieved
+		{entur.Departure{Line: "21", Quay: "NSR:Quay:73154", Inbound: false}, failing, false},
+		{entur.Departure{Line: "21", Quay: "NSR:Quay:73154", Inbound: true}, nil, true},
+	}
+	for i, tt := range tests {
+		if got := rules.Inbound(tt.departure, tt.calls); got != tt.inbound {
+			t.Errorf("#%d: Inbound(%+v) = %t, want %t", i, tt.departure, got, tt.inbound)
+		}
+	}
+}
@@ -1,37 +1,122 @@
 package entur
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DefaultURL is the default Entur Journey Planner API URL. Documentation at
 // https://developer.entur.org/pages-journeyplanner-journeyplanner-v3.
 const DefaultURL = "https://api.entur.io/journey-planner/v3/graphql"
 
-// Client implements a client for the Entur Journey Planner API.
-type Client struct{ URL string }
+// ErrNotFound is returned when the requested object does not exist in Entur.
+var ErrNotFound = errors.New("not found")
+
+// DefaultVehiclesURL is the default Entur Vehicles API URL. Documentation at
+// https://developer.entur.org/pages-real-time-vehicle-positions.
+const DefaultVehiclesURL = "https://api.entur.io/realtime/v1/vehicles/graphql"
+
+// DefaultClientName is the default name identifying this client to Entur.
+const DefaultClientName = "github_mpolden-atb"
 
-// New creates a new client using the API found at url.
+// DefaultOperators contains the default operator ID prefixes of departures returned by the client.
+var DefaultOperators = []string{"ATB:"}
+
+// Client implements a client for the Entur Journey Planner and Vehicles APIs.
+type Client struct {
+	URL string
+	// VehiclesURL is the URL of the Vehicles API. DefaultVehiclesURL is used if empty.
+	VehiclesURL string
+	// ClientName identifies this client in the ET-Client-Name header. DefaultClientName is used if empty.
+	ClientName string
+	// Operators contains the operator ID prefixes of departures to include. DefaultOperators is used if empty. Lines and
+	// vehicles are not filtered by operator, they are always those of AtB.
+	Operators []string
+	// Headers contains additional headers sent with each request.
+	Headers map[string]string
+}
+
+// New creates a new client using the Journey Planner API found at url.
 func New(url string) *Client {
 	if url == "" {
 		url = DefaultURL
 	}
-	return &Client{URL: url}
+	return &Client{URL: url, VehiclesURL: DefaultVehiclesURL}
+}
+
+var tracer = otel.Tracer("github.com/mpolden/atb/entur")
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id. The request ID is sent to Entur in requests made with
+// the returned context, which allows correlating requests.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
 }
 
 // Departure represents a bus departure from a stop.
 type Departure struct {
 	Line                    string
+	LineID                  string
+	ServiceJourneyID        string
+	TransportMode           string
+	Operator                string
+	Quay                    string
+	AimedArrivalTime        time.Time
+	ExpectedArrivalTime     time.Time
+	AimedDepartureTime      time.Time
 	RegisteredDepartureTime time.Time
 	ScheduledDepartureTime  time.Time
 	Destination             string
 	IsRealtime              bool
+	IsCancelled             bool
 	Inbound                 bool
+	// Timetable is true if the departure comes from a static timetable instead of Entur.
+	Timetable bool
+}
+
+// DelayThreshold is the minimum difference between expected and aimed departure time for a departure to be considered
+// delayed.
+const DelayThreshold = time.Minute
+
+// DisplayMinutes is the number of minutes until departure for which the display time is given in minutes, instead of
+// time of day.
+const DisplayMinutes = 10
+
+// CancelledDisplayTime is displayed instead of the departure time of a cancelled departure.
+const CancelledDisplayTime = "innstilt"
+
+// Delayed returns whether real-time data shows d departing at least DelayThreshold after its aimed departure time.
+func (d Departure) Delayed() bool {
+	return d.IsRealtime && !d.AimedDepartureTime.IsZero() && d.ScheduledDepartureTime.Sub(d.AimedDepartureTime) >= DelayThreshold
+}
+
+// DisplayTime returns a display-ready representation of t, relative to now. Departures within a minute are shown as
+// "nå", departures within DisplayMinutes are shown in minutes and remaining departures are shown as time of day.
+func DisplayTime(t, now time.Time) string {
+	until := t.Sub(now)
+	if until < time.Minute {
+		return "nå"
+	}
+	if until < DisplayMinutes*time.Minute {
+		return strconv.Itoa(int(until/time.Minute)) + " min"
+	}
+	return t.Format("15:04")
 }
 
 type response struct {
@@ -50,17 +135,27 @@ type stopPlace struct {
 
 type estimatedCall struct {
 	Realtime              bool               `json:"realtime"`
+	Cancellation          bool               `json:"cancellation"`
+	AimedArrivalTime      string             `json:"aimedArrivalTime"`
+	ExpectedArrivalTime   string             `json:"expectedArrivalTime"`
+	AimedDepartureTime    string             `json:"aimedDepartureTime"`
 	ExpectedDepartureTime string             `json:"expectedDepartureTime"`
 	ActualDepartureTime   string             `json:"actualDepartureTime"`
+	Quay                  quay               `json:"quay"`
 	DestinationDisplay    destinationDisplay `json:"destinationDisplay"`
 	ServiceJourney        serviceJourney     `json:"serviceJourney"`
 }
 
+type quay struct {
+	ID string `json:"id"`
+}
+
 type destinationDisplay struct {
 	FrontText string `json:"frontText"`
 }
 
 type serviceJourney struct {
+	ID             string         `json:"id"`
 	Operator       operator       `json:"operator"`
 	JourneyPattern journeyPattern `json:"journeyPattern"`
 }
@@ -75,50 +170,158 @@ type journeyPattern struct {
 }
 
 type line struct {
-	PublicCode string `json:"publicCode"`
+	ID            string `json:"id"`
+	PublicCode    string `json:"publicCode"`
+	TransportMode string `json:"transportMode"`
 }
 
-// Departures returns departures from the given stop ID. Use https://stoppested.entur.org/ to determine stop IDs.
-func (c *Client) Departures(count, stopID int) ([]Departure, error) {
-	// https://api.entur.io/journey-planner/v2/ide/ for query testing
-	query := fmt.Sprintf(`{"query":"{stopPlace(id:\"NSR:StopPlace:%d\"){id name estimatedCalls(numberOfDepartures:%d){realtime expectedDepartureTime actualDepartureTime destinationDisplay{frontText}serviceJourney{operator{id}journeyPattern{directionType line{publicCode}}}}}}"}`, stopID, count)
-	req, err := http.NewRequest("POST", c.URL, strings.NewReader(query))
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+type graphQLResponse struct {
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func stopPlaceID(stopID int) string { return fmt.Sprintf("NSR:StopPlace:%d", stopID) }
+
+// query sends a GraphQL query with variables to the Journey Planner API and returns the response body. The request is
+// traced in a span with given name and attributes.
+func (c *Client) query(ctx context.Context, name, query string, variables map[string]interface{}, attrs ...attribute.KeyValue) ([]byte, error) {
+	return c.queryURL(ctx, c.URL, name, query, variables, attrs...)
+}
+
+// queryURL sends a GraphQL query to the API found at url.
+func (c *Client) queryURL(ctx context.Context, url, name, query string, variables map[string]interface{}, attrs ...attribute.KeyValue) (body []byte, err error) {
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	data, err := json.Marshal(graphQLRequest{Query: query, Variables: variables})
 	if err != nil {
 		return nil, err
 	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
 	req.Header.Set("Content-Type", "application/json")
 	// Identify this client. See https://developer.entur.org/pages-journeyplanner-journeyplanner-v3
-	req.Header.Set("ET-Client-Name", "github_mpolden-atb")
+	clientName := c.ClientName
+	if clientName == "" {
+		clientName = DefaultClientName
+	}
+	req.Header.Set("ET-Client-Name", clientName)
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		req.Header.Set("X-Correlation-Id", id)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	json, err := ioutil.ReadAll(resp.Body)
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %d", url, resp.StatusCode)
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var r graphQLResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	if len(r.Errors) > 0 {
+		return nil, fmt.Errorf("%s: query failed: %s", url, r.Errors[0].Message)
+	}
+	return body, nil
+}
+
+// Name returns the name of this departure source.
+func (c *Client) Name() string { return "entur" }
+
+// Departures returns departures from the given stop ID. Use https://stoppested.entur.org/ to determine stop IDs.
+func (c *Client) Departures(ctx context.Context, count, stopID int) ([]Departure, error) {
+	return c.estimatedCalls(ctx, "entur.Departures", "departures", count, stopID)
+}
+
+// Arrivals returns arrivals at the given stop ID, ordered by expected arrival time. Unlike Departures, this includes
+// vehicles that terminate at the stop.
+func (c *Client) Arrivals(ctx context.Context, count, stopID int) ([]Departure, error) {
+	arrivals, err := c.estimatedCalls(ctx, "entur.Arrivals", "arrivals", count, stopID)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(arrivals, func(i, j int) bool {
+		return arrivals[i].ExpectedArrivalTime.Before(arrivals[j].ExpectedArrivalTime)
+	})
+	return arrivals, nil
+}
+
+// estimatedCalls returns calls at stopID. arrivalDeparture selects whether calls are arrivals or departures.
+func (c *Client) estimatedCalls(ctx context.Context, name, arrivalDeparture string, count, stopID int) ([]Departure, error) {
+	// https://api.entur.io/graphql-explorer/journey-planner-v3 for query testing
+	const query = `query($id:String!,$count:Int,$arrivalDeparture:ArrivalDeparture){stopPlace(id:$id){id name estimatedCalls(numberOfDepartures:$count,arrivalDeparture:$arrivalDeparture){realtime cancellation aimedArrivalTime expectedArrivalTime aimedDepartureTime expectedDepartureTime actualDepartureTime quay{id}destinationDisplay{frontText}serviceJourney{id operator{id}journeyPattern{directionType line{id publicCode transportMode}}}}}}`
+	variables := map[string]interface{}{"id": stopPlaceID(stopID), "count": count, "arrivalDeparture": arrivalDeparture}
+	body, err := c.query(ctx, name, query, variables, attribute.Int("atb.stop_id", stopID), attribute.Int("atb.count", count))
 	if err != nil {
 		return nil, err
 	}
-	return parseDepartures(json)
+	operators := c.Operators
+	if len(operators) == 0 {
+		operators = DefaultOperators
+	}
+	return parseDepartures(body, operators)
 }
 
-func parseDepartures(jsonData []byte) ([]Departure, error) {
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDepartures(jsonData []byte, operators []string) ([]Departure, error) {
 	var r response
 	if err := json.Unmarshal(jsonData, &r); err != nil {
 		return nil, err
 	}
-	const (
-		operatorPrefix = "ATB:"
-		timeLayout     = "2006-01-02T15:04:05-07:00"
-	)
+	const timeLayout = "2006-01-02T15:04:05-07:00"
 	departures := make([]Departure, 0, len(r.Data.StopPlace.EstimatedCalls))
 	for _, ec := range r.Data.StopPlace.EstimatedCalls {
-		if !strings.HasPrefix(ec.ServiceJourney.Operator.Id, operatorPrefix) {
+		if !hasAnyPrefix(ec.ServiceJourney.Operator.Id, operators) {
 			continue // Skip other operators
 		}
 		scheduledDepartureTime, err := time.Parse(timeLayout, ec.ExpectedDepartureTime)
 		if err != nil {
 			return nil, err
 		}
+		aimedDepartureTime, err := parseTime(ec.AimedDepartureTime)
+		if err != nil {
+			return nil, err
+		}
+		aimedArrivalTime, err := parseTime(ec.AimedArrivalTime)
+		if err != nil {
+			return nil, err
+		}
+		expectedArrivalTime, err := parseTime(ec.ExpectedArrivalTime)
+		if err != nil {
+			return nil, err
+		}
 		registeredDepartureTime := time.Time{}
 		if ec.ActualDepartureTime != "" {
 			t, err := time.Parse(timeLayout, ec.ActualDepartureTime)
@@ -130,10 +333,19 @@ func parseDepartures(jsonData []byte) ([]Departure, error) {
 		inbound := ec.ServiceJourney.JourneyPattern.DirectionType == "inbound"
 		d := Departure{
 			Line:                    ec.ServiceJourney.JourneyPattern.Line.PublicCode,
+			LineID:                  ec.ServiceJourney.JourneyPattern.Line.ID,
+			ServiceJourneyID:        ec.ServiceJourney.ID,
+			TransportMode:           ec.ServiceJourney.JourneyPattern.Line.TransportMode,
+			Operator:                ec.ServiceJourney.Operator.Id,
+			Quay:                    ec.Quay.ID,
+			AimedArrivalTime:        aimedArrivalTime,
+			ExpectedArrivalTime:     expectedArrivalTime,
+			AimedDepartureTime:      aimedDepartureTime,
 			RegisteredDepartureTime: registeredDepartureTime,
 			ScheduledDepartureTime:  scheduledDepartureTime,
 			Destination:             ec.DestinationDisplay.FrontText,
 			IsRealtime:              ec.Realtime,
+			IsCancelled:             ec.Cancellation,
 			Inbound:                 inbound,
 		}
 		departures = append(departures, d)
@@ -1,8 +1,15 @@
 package entur
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,7 +20,7 @@ func TestParseDepartures(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	d, err := parseDepartures(json)
+	d, err := parseDepartures(json, DefaultOperators)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -21,26 +28,53 @@ func TestParseDepartures(t *testing.T) {
 	expected := []Departure{
 		{
 			Line:                    "21",
+			LineID:                  "ATB:Line:2_21",
+			ServiceJourneyID:        "ATB:ServiceJourney:21_220425100219521_1113",
+			TransportMode:           "bus",
+			Operator:                "ATB:Operator:171",
+			Quay:                    "NSR:Quay:73154",
+			AimedArrivalTime:        time.Date(2022, 5, 20, 18, 18, 0, 0, cest),
+			ExpectedArrivalTime:     time.Date(2022, 5, 20, 18, 19, 0, 0, cest),
+			AimedDepartureTime:      time.Date(2022, 5, 20, 18, 18, 0, 0, cest),
 			RegisteredDepartureTime: time.Time{},
 			ScheduledDepartureTime:  time.Date(2022, 5, 20, 18, 19, 0, 0, cest),
 			Destination:             "Pirbadet via sentrum",
 			IsRealtime:              true,
+			IsCancelled:             false,
 			Inbound:                 false,
 		},
 		{
 			Line:                    "21",
+			LineID:                  "ATB:Line:2_21",
+			ServiceJourneyID:        "ATB:ServiceJourney:21_220425100219521_1125",
+			TransportMode:           "bus",
+			Operator:                "ATB:Operator:171",
+			Quay:                    "NSR:Quay:73154",
+			AimedArrivalTime:        time.Date(2022, 5, 20, 19, 19, 0, 0, cest),
+			ExpectedArrivalTime:     time.Date(2022, 5, 20, 19, 19, 0, 0, cest),
+			AimedDepartureTime:      time.Date(2022, 5, 20, 19, 19, 0, 0, cest),
 			RegisteredDepartureTime: time.Time{},
 			ScheduledDepartureTime:  time.Date(2022, 5, 20, 19, 19, 0, 0, cest),
 			Destination:             "Pirbadet via sentrum",
 			IsRealtime:              true,
+			IsCancelled:             false,
 			Inbound:                 false,
 		},
 		{
 			Line:                    "21",
+			LineID:                  "ATB:Line:2_21",
+			ServiceJourneyID:        "ATB:ServiceJourney:21_220425100219521_1137",
+			TransportMode:           "bus",
+			Operator:                "ATB:Operator:171",
+			Quay:                    "NSR:Quay:73154",
+			AimedArrivalTime:        time.Date(2022, 5, 20, 20, 19, 0, 0, cest),
+			ExpectedArrivalTime:     time.Date(2022, 5, 20, 20, 19, 0, 0, cest),
+			AimedDepartureTime:      time.Date(2022, 5, 20, 20, 19, 0, 0, cest),
 			RegisteredDepartureTime: time.Time{},
 			ScheduledDepartureTime:  time.Date(2022, 5, 20, 20, 19, 0, 0, cest),
 			Destination:             "Pirbadet via sentrum",
 			IsRealtime:              true,
+			IsCancelled:             true,
 			Inbound:                 false,
 		},
 	}
@@ -50,6 +84,30 @@ func TestParseDepartures(t *testing.T) {
 		if want.Line != got.Line {
 			t.Errorf("#%d: want Line = %q, got %q", i, want.Line, got.Line)
 		}
+		if want.LineID != got.LineID {
+			t.Errorf("#%d: want LineID = %q, got %q", i, want.LineID, got.LineID)
+		}
+		if want.ServiceJourneyID != got.ServiceJourneyID {
+			t.Errorf("#%d: want ServiceJourneyID = %q, got %q", i, want.ServiceJourneyID, got.ServiceJourneyID)
+		}
+		if want.TransportMode != got.TransportMode {
+			t.Errorf("#%d: want TransportMode = %q, got %q", i, want.TransportMode, got.TransportMode)
+		}
+		if want.Operator != got.Operator {
+			t.Errorf("#%d: want Operator = %q, got %q", i, want.Operator, got.Operator)
+		}
+		if want.Quay != got.Quay {
+			t.Errorf("#%d: want Quay = %q, got %q", i, want.Quay, got.Quay)
+		}
+		if !want.AimedArrivalTime.Equal(got.AimedArrivalTime) {
+			t.Errorf("#%d: want AimedArrivalTime = %q, got %q", i, want.AimedArrivalTime, got.AimedArrivalTime)
+		}
+		if !want.ExpectedArrivalTime.Equal(got.ExpectedArrivalTime) {
+			t.Errorf("#%d: want ExpectedArrivalTime = %q, got %q", i, want.ExpectedArrivalTime, got.ExpectedArrivalTime)
+		}
+		if !want.AimedDepartureTime.Equal(got.AimedDepartureTime) {
+			t.Errorf("#%d: want AimedDepartureTime = %q, got %q", i, want.AimedDepartureTime, got.AimedDepartureTime)
+		}
 		if !want.RegisteredDepartureTime.Equal(got.RegisteredDepartureTime) {
 			t.Errorf("#%d: want RegisteredDepartureTime = %q, got %q", i, want.RegisteredDepartureTime, got.RegisteredDepartureTime)
 		}
@@ -62,8 +120,391 @@ func TestParseDepartures(t *testing.T) {
 		if want.IsRealtime != got.IsRealtime {
 			t.Errorf("#%d: want IsRealtime = %t, got %t", i, want.IsRealtime, got.IsRealtime)
 		}
+		if want.IsCancelled != got.IsCancelled {
+			t.Errorf("#%d: want IsCancelled = %t, got %t", i, want.IsCancelled, got.IsCancelled)
+		}
 		if want.Inbound != got.Inbound {
 			t.Errorf("#%d: want Inbound = %t, got %t", i, want.Inbound, got.Inbound)
 		}
 	}
+	other, err := parseDepartures(json, []string{"SKY:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other) != 0 {
+		t.Errorf("want no departures from other operators, got %d", len(other))
+	}
+}
+
+func TestParseStop(t *testing.T) {
+	json, err := ioutil.ReadFile(filepath.Join("testdata", "prinsens-gate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseStop(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Stop{
+		ID:        "NSR:StopPlace:41613",
+		Name:      "Prinsens gate",
+		Latitude:  63.431034,
+		Longitude: 10.392086,
+		Quays: []Quay{
+			{ID: "NSR:Quay:71184", Name: "Prinsens gate", PublicCode: "P1", Latitude: 63.431099, Longitude: 10.391986},
+			{ID: "NSR:Quay:71181", Name: "Prinsens gate", PublicCode: "P2", Latitude: 63.430969, Longitude: 10.392186},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := parseStop([]byte(`{"data":{"stopPlace":null}}`)); err == nil {
+		t.Error("want error for missing stop place")
+	}
+}
+
+func TestParseSituations(t *testing.T) {
+	json, err := ioutil.ReadFile(filepath.Join("testdata", "prinsens-gate-situations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseSituations(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cest := time.FixedZone("CEST", 7200)
+	want := []Situation{
+		{
+			ID:          "ATB:SituationNumber:1234",
+			Summary:     "Holdeplassen er flyttet",
+			Description: "The stop has moved 50 metres north due to road work",
+			Severity:    "normal",
+			ValidFrom:   time.Date(2022, 5, 20, 6, 0, 0, 0, cest),
+			ValidTo:     time.Date(2022, 6, 1, 23, 59, 0, 0, cest),
+		},
+		{
+			ID:        "ATB:SituationNumber:1240",
+			Summary:   "Innstilt avgang",
+			Severity:  "severe",
+			ValidFrom: time.Date(2022, 5, 20, 17, 0, 0, 0, cest),
+		},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d situations, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Summary != want[i].Summary || got[i].Description != want[i].Description ||
+			got[i].Severity != want[i].Severity || !got[i].ValidFrom.Equal(want[i].ValidFrom) || !got[i].ValidTo.Equal(want[i].ValidTo) {
+			t.Errorf("#%d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	var tests = []struct {
+		status   int
+		response string
+		err      string
+	}{
+		{200, `{"data":{"stopPlace":{"id":"NSR:StopPlace:41613","name":"Prinsens gate"}}}`, ""},
+		{200, `{"errors":[{"message":"Invalid id"}]}`, "query failed: Invalid id"},
+		{503, ``, "unexpected status 503"},
+	}
+	for i, tt := range tests {
+		var body graphQLRequest
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.response))
+		}))
+		_, err := New(srv.URL).Stop(context.Background(), 41613)
+		srv.Close()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if (tt.err == "" && got != "") || !strings.HasSuffix(got, tt.err) {
+			t.Errorf("#%d: got error %q, want %q", i, got, tt.err)
+		}
+		if got, want := body.Variables["id"], "NSR:StopPlace:41613"; got != want {
+			t.Errorf("#%d: got id variable %v, want %s", i, got, want)
+		}
+	}
+}
+
+func TestParseTrips(t *testing.T) {
+	json, err := ioutil.ReadFile(filepath.Join("testdata", "trip.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseTrips(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cest := time.FixedZone("", 7200)
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, cest) }
+	prinsensGate := Place{Name: "Prinsens gate", StopPlace: "NSR:StopPlace:41613", Quay: "NSR:Quay:71184"}
+	kongensGate := Place{Name: "Kongens gate", StopPlace: "NSR:StopPlace:41620", Quay: "NSR:Quay:71204"}
+	ilsvika := Place{Name: "Ilsvika", StopPlace: "NSR:StopPlace:42098", Quay: "NSR:Quay:73154"}
+	want := []Trip{
+		{
+			StartTime:    at(18, 14),
+			EndTime:      at(18, 31),
+			Duration:     17 * time.Minute,
+			WalkDistance: 260.5,
+			Legs: []Leg{
+				{
+					Mode:              "foot",
+					From:              prinsensGate,
+					To:                kongensGate,
+					AimedStartTime:    at(18, 14),
+					ExpectedStartTime: at(18, 14),
+					AimedEndTime:      at(18, 18),
+					ExpectedEndTime:   at(18, 18),
+					Distance:          260.5,
+				},
+				{
+					Mode:              "bus",
+					Line:              "21",
+					LineID:            "ATB:Line:2_21",
+					ServiceJourneyID:  "ATB:ServiceJourney:21_220425100219521_1113",
+					Destination:       "Pirbadet via sentrum",
+					From:              kongensGate,
+					To:                ilsvika,
+					AimedStartTime:    at(18, 18),
+					ExpectedStartTime: at(18, 19),
+					AimedEndTime:      at(18, 30),
+					ExpectedEndTime:   at(18, 31),
+					Distance:          3120.2,
+					IsRealtime:        true,
+				},
+			},
+		},
+		{
+			StartTime: at(18, 25),
+			EndTime:   at(18, 37),
+			Duration:  12 * time.Minute,
+			Legs: []Leg{
+				{
+					Mode:              "bus",
+					Line:              "21",
+					LineID:            "ATB:Line:2_21",
+					ServiceJourneyID:  "ATB:ServiceJourney:21_220425100219521_1114",
+					Destination:       "Pirbadet via sentrum",
+					From:              Place{Name: "Prinsens gate", StopPlace: "NSR:StopPlace:41613", Quay: "NSR:Quay:71181"},
+					To:                ilsvika,
+					AimedStartTime:    at(18, 25),
+					ExpectedStartTime: at(18, 25),
+					AimedEndTime:      at(18, 37),
+					ExpectedEndTime:   at(18, 37),
+					Distance:          2980,
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestParseServiceJourney(t *testing.T) {
+	json, err := ioutil.ReadFile(filepath.Join("testdata", "service-journey.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseServiceJourney(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cest := time.FixedZone("", 7200)
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, cest) }
+	want := ServiceJourney{
+		ID:     "ATB:ServiceJourney:21_220425100219521_1113",
+		Line:   "21",
+		LineID: "ATB:Line:2_21",
+		Calls: []Call{
+			{
+				StopPlace:             "NSR:StopPlace:42098",
+				Quay:                  "NSR:Quay:73154",
+				Name:                  "Ilsvika",
+				Destination:           "Pirbadet via sentrum",
+				AimedArrivalTime:      at(18, 10),
+				ExpectedArrivalTime:   at(18, 11),
+				AimedDepartureTime:    at(18, 10),
+				ExpectedDepartureTime: at(18, 11),
+				IsRealtime:            true,
+			},
+			{
+				StopPlace:             "NSR:StopPlace:41613",
+				Quay:                  "NSR:Quay:71184",
+				Name:                  "Prinsens gate",
+				Destination:           "Pirbadet via sentrum",
+				AimedArrivalTime:      at(18, 18),
+				ExpectedArrivalTime:   at(18, 19),
+				AimedDepartureTime:    at(18, 18),
+				ExpectedDepartureTime: at(18, 20),
+				IsRealtime:            true,
+			},
+			{
+				StopPlace:             "NSR:StopPlace:41730",
+				Quay:                  "NSR:Quay:71850",
+				Name:                  "Pirbadet",
+				Destination:           "Pirbadet",
+				AimedArrivalTime:      at(18, 25),
+				ExpectedArrivalTime:   at(18, 25),
+				AimedDepartureTime:    at(18, 25),
+				ExpectedDepartureTime: at(18, 25),
+				IsCancelled:           true,
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	_, err = parseServiceJourney([]byte(`{"data":{"serviceJourney":null}}`))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	json, err := ioutil.ReadFile(filepath.Join("testdata", "lines.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseLines(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pirbadet := Place{Name: "Pirbadet", StopPlace: "NSR:StopPlace:41730"}
+	prinsensGate := Place{Name: "Prinsens gate", StopPlace: "NSR:StopPlace:41613"}
+	ilsvika := Place{Name: "Ilsvika", StopPlace: "NSR:StopPlace:42098"}
+	want := []Line{
+		{
+			ID:            "ATB:Line:2_3",
+			PublicCode:    "3",
+			Name:          "Lohove - Hallset",
+			TransportMode: "bus",
+			Colour:        "E60000",
+			TextColour:    "FFFFFF",
+			Operator:      "Tide Buss",
+		},
+		{
+			ID:            "ATB:Line:2_21",
+			PublicCode:    "21",
+			Name:          "Pirbadet - Ilsvika",
+			TransportMode: "bus",
+			Colour:        "00A6DE",
+			TextColour:    "FFFFFF",
+			Operator:      "Vy Buss",
+			Routes: []Route{
+				{Direction: "inbound", Stops: []Place{ilsvika, prinsensGate, pirbadet}},
+				{Direction: "outbound", Stops: []Place{pirbadet, prinsensGate, ilsvika}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestVehicles(t *testing.T) {
+	json, err := ioutil.ReadFile(filepath.Join("testdata", "vehicles.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var path, clientName, header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		clientName = r.Header.Get("ET-Client-Name")
+		header = r.Header.Get("X-Api-Key")
+		w.Write(json)
+	}))
+	defer srv.Close()
+	client := New("http://127.0.0.1:0")
+	client.VehiclesURL = srv.URL + "/vehicles"
+	client.ClientName = "example-board"
+	client.Headers = map[string]string{"X-Api-Key": "s3cret"}
+	got, err := client.Vehicles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/vehicles" {
+		t.Errorf("want request to /vehicles, got %s", path)
+	}
+	if clientName != "example-board" {
+		t.Errorf("want ET-Client-Name example-board, got %s", clientName)
+	}
+	if header != "s3cret" {
+		t.Errorf("want X-Api-Key s3cret, got %s", header)
+	}
+	cest := time.FixedZone("", 7200)
+	want := []Vehicle{
+		{
+			ID:               "3052",
+			Line:             "3",
+			LineID:           "ATB:Line:2_3",
+			ServiceJourneyID: "ATB:ServiceJourney:3_210811",
+			Destination:      "Hallset",
+			Latitude:         63.430612,
+			Longitude:        10.394321,
+			Bearing:          271.5,
+			Delay:            94 * time.Second,
+			LastUpdated:      time.Date(2022, 5, 20, 18, 19, 5, 123000000, cest),
+		},
+		{
+			ID:               "3117",
+			Line:             "21",
+			LineID:           "ATB:Line:2_21",
+			ServiceJourneyID: "ATB:ServiceJourney:21_220425100219521_1113",
+			Destination:      "Pirbadet via sentrum",
+			Latitude:         63.434205,
+			Longitude:        10.356812,
+			Bearing:          88,
+			Delay:            -30 * time.Second,
+			LastUpdated:      time.Date(2022, 5, 20, 18, 19, 2, 0, cest),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestDelayed(t *testing.T) {
+	aimed := time.Date(2022, 5, 20, 18, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		d    Departure
+		want bool
+	}{
+		{Departure{AimedDepartureTime: aimed, ScheduledDepartureTime: aimed.Add(time.Minute), IsRealtime: true}, true},
+		{Departure{AimedDepartureTime: aimed, ScheduledDepartureTime: aimed.Add(59 * time.Second), IsRealtime: true}, false},
+		{Departure{AimedDepartureTime: aimed, ScheduledDepartureTime: aimed.Add(time.Minute)}, false},
+		{Departure{ScheduledDepartureTime: aimed.Add(time.Minute), IsRealtime: true}, false},
+	}
+	for i, tt := range tests {
+		if got := tt.d.Delayed(); got != tt.want {
+			t.Errorf("#%d: want %t, got %t", i, tt.want, got)
+		}
+	}
+}
+
+func TestDisplayTime(t *testing.T) {
+	now := time.Date(2022, 5, 20, 18, 0, 30, 0, time.UTC)
+	var tests = []struct {
+		t    time.Time
+		want string
+	}{
+		{now.Add(-time.Minute), "nå"},
+		{now.Add(59 * time.Second), "nå"},
+		{now.Add(time.Minute), "1 min"},
+		{now.Add(9*time.Minute + 59*time.Second), "9 min"},
+		{now.Add(10 * time.Minute), "18:10"},
+	}
+	for _, tt := range tests {
+		if got := DisplayTime(tt.t, now); got != tt.want {
+			t.Errorf("DisplayTime(%s, %s) = %q, want %q", tt.t, now, got, tt.want)
+		}
+	}
 }
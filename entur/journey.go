@@ -0,0 +1,111 @@
+package entur
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ServiceJourney represents a single run of a vehicle along a line.
+type ServiceJourney struct {
+	ID     string
+	Line   string
+	LineID string
+	Calls  []Call
+}
+
+// Call represents a visit by a service journey to a stop.
+type Call struct {
+	StopPlace             string
+	Quay                  string
+	Name                  string
+	Destination           string
+	AimedArrivalTime      time.Time
+	ExpectedArrivalTime   time.Time
+	AimedDepartureTime    time.Time
+	ExpectedDepartureTime time.Time
+	IsRealtime            bool
+	IsCancelled           bool
+}
+
+type serviceJourneyResponse struct {
+	Data struct {
+		ServiceJourney *struct {
+			ID             string `json:"id"`
+			Line           line   `json:"line"`
+			EstimatedCalls []struct {
+				AimedArrivalTime      string             `json:"aimedArrivalTime"`
+				ExpectedArrivalTime   string             `json:"expectedArrivalTime"`
+				AimedDepartureTime    string             `json:"aimedDepartureTime"`
+				ExpectedDepartureTime string             `json:"expectedDepartureTime"`
+				Realtime              bool               `json:"realtime"`
+				Cancellation          bool               `json:"cancellation"`
+				DestinationDisplay    destinationDisplay `json:"destinationDisplay"`
+				Quay                  struct {
+					ID        string `json:"id"`
+					Name      string `json:"name"`
+					StopPlace struct {
+						ID string `json:"id"`
+					} `json:"stopPlace"`
+				} `json:"quay"`
+			} `json:"estimatedCalls"`
+		} `json:"serviceJourney"`
+	} `json:"data"`
+}
+
+// ServiceJourney returns the service journey identified by id, including all its calls in order.
+func (c *Client) ServiceJourney(ctx context.Context, id string) (ServiceJourney, error) {
+	const query = `query($id:String!){serviceJourney(id:$id){id line{id publicCode transportMode}estimatedCalls{aimedArrivalTime expectedArrivalTime aimedDepartureTime expectedDepartureTime realtime cancellation destinationDisplay{frontText}quay{id name stopPlace{id}}}}}`
+	variables := map[string]interface{}{"id": id}
+	body, err := c.query(ctx, "entur.ServiceJourney", query, variables, attribute.String("atb.service_journey_id", id))
+	if err != nil {
+		return ServiceJourney{}, err
+	}
+	return parseServiceJourney(body)
+}
+
+func parseServiceJourney(jsonData []byte) (ServiceJourney, error) {
+	var r serviceJourneyResponse
+	if err := json.Unmarshal(jsonData, &r); err != nil {
+		return ServiceJourney{}, err
+	}
+	sj := r.Data.ServiceJourney
+	if sj == nil {
+		return ServiceJourney{}, fmt.Errorf("service journey %w", ErrNotFound)
+	}
+	calls := make([]Call, 0, len(sj.EstimatedCalls))
+	for _, ec := range sj.EstimatedCalls {
+		call := Call{
+			StopPlace:   ec.Quay.StopPlace.ID,
+			Quay:        ec.Quay.ID,
+			Name:        ec.Quay.Name,
+			Destination: ec.DestinationDisplay.FrontText,
+			IsRealtime:  ec.Realtime,
+			IsCancelled: ec.Cancellation,
+		}
+		var err error
+		for _, v := range []struct {
+			dst *time.Time
+			src string
+		}{
+			{&call.AimedArrivalTime, ec.AimedArrivalTime},
+			{&call.ExpectedArrivalTime, ec.ExpectedArrivalTime},
+			{&call.AimedDepartureTime, ec.AimedDepartureTime},
+			{&call.ExpectedDepartureTime, ec.ExpectedDepartureTime},
+		} {
+			if *v.dst, err = parseTime(v.src); err != nil {
+				return ServiceJourney{}, err
+			}
+		}
+		calls = append(calls, call)
+	}
+	return ServiceJourney{
+		ID:     sj.ID,
+		Line:   sj.Line.PublicCode,
+		LineID: sj.Line.ID,
+		Calls:  calls,
+	}, nil
+}
@@ -0,0 +1,150 @@
+package entur
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// codespace is the AtB codespace in Entur. Lines and vehicles are always those of this codespace, regardless of
+	// Client.Operators.
+	codespace = "ATB"
+	// authority is the ID of the AtB authority in Entur.
+	authority = codespace + ":Authority:2"
+)
+
+// Line represents a public transport line.
+type Line struct {
+	ID            string
+	PublicCode    string
+	Name          string
+	TransportMode string
+	Colour        string
+	TextColour    string
+	Operator      string
+	Routes        []Route
+}
+
+// Route represents the stops served by a line in one direction.
+type Route struct {
+	Direction string
+	Stops     []Place
+}
+
+type lineResponse struct {
+	ID            string `json:"id"`
+	PublicCode    string `json:"publicCode"`
+	Name          string `json:"name"`
+	TransportMode string `json:"transportMode"`
+	Presentation  struct {
+		Colour     string `json:"colour"`
+		TextColour string `json:"textColour"`
+	} `json:"presentation"`
+	Operator *struct {
+		Name string `json:"name"`
+	} `json:"operator"`
+	JourneyPatterns []struct {
+		DirectionType string `json:"directionType"`
+		Quays         []struct {
+			Name      string `json:"name"`
+			StopPlace struct {
+				ID string `json:"id"`
+			} `json:"stopPlace"`
+		} `json:"quays"`
+	} `json:"journeyPatterns"`
+}
+
+type linesResponse struct {
+	Data struct {
+		Lines []lineResponse `json:"lines"`
+	} `json:"data"`
+}
+
+// Lines returns all lines operated by AtB, without routes.
+func (c *Client) Lines(ctx context.Context) ([]Line, error) {
+	const query = `query($authorities:[String]){lines(authorities:$authorities){id publicCode name transportMode presentation{colour textColour}operator{name}}}`
+	variables := map[string]interface{}{"authorities": []string{authority}}
+	body, err := c.query(ctx, "entur.Lines", query, variables)
+	if err != nil {
+		return nil, err
+	}
+	return parseLines(body)
+}
+
+// Line returns the AtB line with given public code, including the stops served in each direction.
+func (c *Client) Line(ctx context.Context, publicCode string) (Line, error) {
+	const query = `query($authorities:[String],$publicCode:String){lines(authorities:$authorities,publicCode:$publicCode){id publicCode name transportMode presentation{colour textColour}operator{name}journeyPatterns{directionType quays{name stopPlace{id}}}}}`
+	variables := map[string]interface{}{"authorities": []string{authority}, "publicCode": publicCode}
+	body, err := c.query(ctx, "entur.Line", query, variables, attribute.String("atb.line", publicCode))
+	if err != nil {
+		return Line{}, err
+	}
+	lines, err := parseLines(body)
+	if err != nil {
+		return Line{}, err
+	}
+	for _, l := range lines {
+		if l.PublicCode == publicCode {
+			return l, nil
+		}
+	}
+	return Line{}, fmt.Errorf("line %s %w", publicCode, ErrNotFound)
+}
+
+func parseLines(jsonData []byte) ([]Line, error) {
+	var r linesResponse
+	if err := json.Unmarshal(jsonData, &r); err != nil {
+		return nil, err
+	}
+	lines := make([]Line, 0, len(r.Data.Lines))
+	for _, l := range r.Data.Lines {
+		if !strings.HasPrefix(l.ID, codespace+":") {
+			continue // Skip other authorities
+		}
+		line := Line{
+			ID:            l.ID,
+			PublicCode:    l.PublicCode,
+			Name:          l.Name,
+			TransportMode: l.TransportMode,
+			Colour:        l.Presentation.Colour,
+			TextColour:    l.Presentation.TextColour,
+		}
+		if l.Operator != nil {
+			line.Operator = l.Operator.Name
+		}
+		// A line has several journey patterns per direction, e.g. for short turns. Use the longest pattern in each
+		// direction as its route
+		longest := make(map[string]int)
+		for i, jp := range l.JourneyPatterns {
+			j, ok := longest[jp.DirectionType]
+			if !ok || len(jp.Quays) > len(l.JourneyPatterns[j].Quays) {
+				longest[jp.DirectionType] = i
+			}
+		}
+		for direction, i := range longest {
+			quays := l.JourneyPatterns[i].Quays
+			stops := make([]Place, 0, len(quays))
+			for _, q := range quays {
+				stops = append(stops, Place{Name: q.Name, StopPlace: q.StopPlace.ID})
+			}
+			line.Routes = append(line.Routes, Route{Direction: direction, Stops: stops})
+		}
+		sort.Slice(line.Routes, func(i, j int) bool { return line.Routes[i].Direction < line.Routes[j].Direction })
+		lines = append(lines, line)
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lessPublicCode(lines[i].PublicCode, lines[j].PublicCode) })
+	return lines, nil
+}
+
+// lessPublicCode orders public codes by length first, which orders numeric codes numerically, e.g. 3 before 21.
+func lessPublicCode(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,109 @@
+package entur
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Situation represents a disruption or other deviation affecting a stop, such as a cancelled or moved stop.
+type Situation struct {
+	ID          string
+	Summary     string
+	Description string
+	Severity    string
+	ValidFrom   time.Time
+	ValidTo     time.Time
+}
+
+type multilingualString struct {
+	Value    string `json:"value"`
+	Language string `json:"language"`
+}
+
+type situation struct {
+	SituationNumber string               `json:"situationNumber"`
+	Summary         []multilingualString `json:"summary"`
+	Description     []multilingualString `json:"description"`
+	Severity        string               `json:"severity"`
+	ValidityPeriod  struct {
+		StartTime string `json:"startTime"`
+		EndTime   string `json:"endTime"`
+	} `json:"validityPeriod"`
+}
+
+type situationsResponse struct {
+	Data struct {
+		StopPlace struct {
+			Situations []situation `json:"situations"`
+			Quays      []struct {
+				Situations []situation `json:"situations"`
+			} `json:"quays"`
+		} `json:"stopPlace"`
+	} `json:"data"`
+}
+
+// Situations returns the situations affecting the stop place identified by stopID, or any of its quays.
+func (c *Client) Situations(ctx context.Context, stopID int) ([]Situation, error) {
+	const situationFields = `situationNumber summary{value language}description{value language}severity validityPeriod{startTime endTime}`
+	const query = `query($id:String!){stopPlace(id:$id){situations{` + situationFields + `}quays{situations{` + situationFields + `}}}}`
+	variables := map[string]interface{}{"id": stopPlaceID(stopID)}
+	body, err := c.query(ctx, "entur.Situations", query, variables, attribute.Int("atb.stop_id", stopID))
+	if err != nil {
+		return nil, err
+	}
+	return parseSituations(body)
+}
+
+// localized returns the Norwegian variant of s, if any, and otherwise the first variant.
+func localized(s []multilingualString) string {
+	for _, v := range s {
+		if v.Language == "no" || v.Language == "nob" {
+			return v.Value
+		}
+	}
+	if len(s) > 0 {
+		return s[0].Value
+	}
+	return ""
+}
+
+func parseSituations(jsonData []byte) ([]Situation, error) {
+	var r situationsResponse
+	if err := json.Unmarshal(jsonData, &r); err != nil {
+		return nil, err
+	}
+	all := r.Data.StopPlace.Situations
+	for _, q := range r.Data.StopPlace.Quays {
+		all = append(all, q.Situations...)
+	}
+	seen := make(map[string]bool)
+	situations := make([]Situation, 0, len(all))
+	for _, s := range all {
+		if seen[s.SituationNumber] {
+			continue // Situations affecting multiple quays are repeated
+		}
+		seen[s.SituationNumber] = true
+		situation := Situation{
+			ID:          s.SituationNumber,
+			Summary:     localized(s.Summary),
+			Description: localized(s.Description),
+			Severity:    s.Severity,
+		}
+		var err error
+		if s.ValidityPeriod.StartTime != "" {
+			if situation.ValidFrom, err = time.Parse(time.RFC3339, s.ValidityPeriod.StartTime); err != nil {
+				return nil, err
+			}
+		}
+		if s.ValidityPeriod.EndTime != "" {
+			if situation.ValidTo, err = time.Parse(time.RFC3339, s.ValidityPeriod.EndTime); err != nil {
+				return nil, err
+			}
+		}
+		situations = append(situations, situation)
+	}
+	return situations, nil
+}
@@ -0,0 +1,84 @@
+package entur
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Stop represents a stop place, consisting of one or more quays.
+type Stop struct {
+	ID        string
+	Name      string
+	Latitude  float64
+	Longitude float64
+	Quays     []Quay
+}
+
+// Quay represents a single platform or stopping point at a stop place.
+type Quay struct {
+	ID         string
+	Name       string
+	PublicCode string
+	Latitude   float64
+	Longitude  float64
+}
+
+type stopResponse struct {
+	Data struct {
+		StopPlace *struct {
+			ID        string  `json:"id"`
+			Name      string  `json:"name"`
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+			Quays     []struct {
+				ID         string  `json:"id"`
+				Name       string  `json:"name"`
+				PublicCode string  `json:"publicCode"`
+				Latitude   float64 `json:"latitude"`
+				Longitude  float64 `json:"longitude"`
+			} `json:"quays"`
+		} `json:"stopPlace"`
+	} `json:"data"`
+}
+
+// Stop returns the stop place identified by stopID.
+func (c *Client) Stop(ctx context.Context, stopID int) (Stop, error) {
+	const query = `query($id:String!){stopPlace(id:$id){id name latitude longitude quays{id name publicCode latitude longitude}}}`
+	variables := map[string]interface{}{"id": stopPlaceID(stopID)}
+	body, err := c.query(ctx, "entur.Stop", query, variables, attribute.Int("atb.stop_id", stopID))
+	if err != nil {
+		return Stop{}, err
+	}
+	return parseStop(body)
+}
+
+func parseStop(jsonData []byte) (Stop, error) {
+	var r stopResponse
+	if err := json.Unmarshal(jsonData, &r); err != nil {
+		return Stop{}, err
+	}
+	sp := r.Data.StopPlace
+	if sp == nil {
+		return Stop{}, fmt.Errorf("stop place %w", ErrNotFound)
+	}
+	quays := make([]Quay, 0, len(sp.Quays))
+	for _, q := range sp.Quays {
+		quays = append(quays, Quay{
+			ID:         q.ID,
+			Name:       q.Name,
+			PublicCode: q.PublicCode,
+			Latitude:   q.Latitude,
+			Longitude:  q.Longitude,
+		})
+	}
+	return Stop{
+		ID:        sp.ID,
+		Name:      sp.Name,
+		Latitude:  sp.Latitude,
+		Longitude: sp.Longitude,
+		Quays:     quays,
+	}, nil
+}
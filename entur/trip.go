@@ -0,0 +1,176 @@
+package entur
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Trip represents a suggested journey between two places, consisting of one or more legs.
+type Trip struct {
+	StartTime    time.Time
+	EndTime      time.Time
+	Duration     time.Duration
+	WalkDistance float64
+	Legs         []Leg
+}
+
+// Leg represents a single part of a trip, either on foot or by public transport.
+type Leg struct {
+	Mode              string
+	Line              string
+	LineID            string
+	ServiceJourneyID  string
+	Destination       string
+	From              Place
+	To                Place
+	AimedStartTime    time.Time
+	ExpectedStartTime time.Time
+	AimedEndTime      time.Time
+	ExpectedEndTime   time.Time
+	Distance          float64
+	IsRealtime        bool
+}
+
+// Place represents the start or end of a leg. StopPlace and Quay are empty if the place is not a stop.
+type Place struct {
+	Name      string
+	StopPlace string
+	Quay      string
+}
+
+type tripPlace struct {
+	Name string `json:"name"`
+	Quay *struct {
+		ID        string `json:"id"`
+		StopPlace struct {
+			ID string `json:"id"`
+		} `json:"stopPlace"`
+	} `json:"quay"`
+}
+
+type tripResponse struct {
+	Data struct {
+		Trip struct {
+			TripPatterns []struct {
+				ExpectedStartTime string  `json:"expectedStartTime"`
+				ExpectedEndTime   string  `json:"expectedEndTime"`
+				Duration          int     `json:"duration"`
+				WalkDistance      float64 `json:"walkDistance"`
+				Legs              []struct {
+					Mode              string    `json:"mode"`
+					Distance          float64   `json:"distance"`
+					Realtime          bool      `json:"realtime"`
+					AimedStartTime    string    `json:"aimedStartTime"`
+					ExpectedStartTime string    `json:"expectedStartTime"`
+					AimedEndTime      string    `json:"aimedEndTime"`
+					ExpectedEndTime   string    `json:"expectedEndTime"`
+					FromPlace         tripPlace `json:"fromPlace"`
+					ToPlace           tripPlace `json:"toPlace"`
+					Line              *line     `json:"line"`
+					ServiceJourney    *struct {
+						ID string `json:"id"`
+					} `json:"serviceJourney"`
+					FromEstimatedCall *struct {
+						DestinationDisplay destinationDisplay `json:"destinationDisplay"`
+					} `json:"fromEstimatedCall"`
+				} `json:"legs"`
+			} `json:"tripPatterns"`
+		} `json:"trip"`
+	} `json:"data"`
+}
+
+// Trips returns suggested trips from stop fromID to stop toID. If arriveBy is true, the trips arrive before t,
+// otherwise they depart after t.
+func (c *Client) Trips(ctx context.Context, fromID, toID int, t time.Time, arriveBy bool) ([]Trip, error) {
+	const query = `query($from:String!,$to:String!,$dateTime:DateTime!,$arriveBy:Boolean){trip(from:{place:$from},to:{place:$to},dateTime:$dateTime,arriveBy:$arriveBy){tripPatterns{expectedStartTime expectedEndTime duration walkDistance legs{mode distance realtime aimedStartTime expectedStartTime aimedEndTime expectedEndTime fromPlace{name quay{id stopPlace{id}}}toPlace{name quay{id stopPlace{id}}}line{id publicCode transportMode}serviceJourney{id}fromEstimatedCall{destinationDisplay{frontText}}}}}}`
+	variables := map[string]interface{}{
+		"from":     stopPlaceID(fromID),
+		"to":       stopPlaceID(toID),
+		"dateTime": t.Format(time.RFC3339),
+		"arriveBy": arriveBy,
+	}
+	body, err := c.query(ctx, "entur.Trips", query, variables, attribute.Int("atb.from_stop_id", fromID), attribute.Int("atb.to_stop_id", toID))
+	if err != nil {
+		return nil, err
+	}
+	return parseTrips(body)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02T15:04:05-07:00", s)
+}
+
+func convertPlace(p tripPlace) Place {
+	place := Place{Name: p.Name}
+	if p.Quay != nil {
+		place.Quay = p.Quay.ID
+		place.StopPlace = p.Quay.StopPlace.ID
+	}
+	return place
+}
+
+func parseTrips(jsonData []byte) ([]Trip, error) {
+	var r tripResponse
+	if err := json.Unmarshal(jsonData, &r); err != nil {
+		return nil, err
+	}
+	trips := make([]Trip, 0, len(r.Data.Trip.TripPatterns))
+	for _, tp := range r.Data.Trip.TripPatterns {
+		startTime, err := parseTime(tp.ExpectedStartTime)
+		if err != nil {
+			return nil, err
+		}
+		endTime, err := parseTime(tp.ExpectedEndTime)
+		if err != nil {
+			return nil, err
+		}
+		legs := make([]Leg, 0, len(tp.Legs))
+		for _, l := range tp.Legs {
+			leg := Leg{
+				Mode:       l.Mode,
+				From:       convertPlace(l.FromPlace),
+				To:         convertPlace(l.ToPlace),
+				Distance:   l.Distance,
+				IsRealtime: l.Realtime,
+			}
+			for _, v := range []struct {
+				dst *time.Time
+				src string
+			}{
+				{&leg.AimedStartTime, l.AimedStartTime},
+				{&leg.ExpectedStartTime, l.ExpectedStartTime},
+				{&leg.AimedEndTime, l.AimedEndTime},
+				{&leg.ExpectedEndTime, l.ExpectedEndTime},
+			} {
+				if *v.dst, err = parseTime(v.src); err != nil {
+					return nil, err
+				}
+			}
+			if l.Line != nil {
+				leg.Line = l.Line.PublicCode
+				leg.LineID = l.Line.ID
+			}
+			if l.ServiceJourney != nil {
+				leg.ServiceJourneyID = l.ServiceJourney.ID
+			}
+			if l.FromEstimatedCall != nil {
+				leg.Destination = l.FromEstimatedCall.DestinationDisplay.FrontText
+			}
+			legs = append(legs, leg)
+		}
+		trips = append(trips, Trip{
+			StartTime:    startTime,
+			EndTime:      endTime,
+			Duration:     time.Duration(tp.Duration) * time.Second,
+			WalkDistance: tp.WalkDistance,
+			Legs:         legs,
+		})
+	}
+	return trips, nil
+}
@@ -0,0 +1,86 @@
+package entur
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// Vehicle represents the last known position of a vehicle.
+type Vehicle struct {
+	ID               string
+	Line             string
+	LineID           string
+	ServiceJourneyID string
+	Destination      string
+	Latitude         float64
+	Longitude        float64
+	Bearing          float64
+	Delay            time.Duration
+	LastUpdated      time.Time
+}
+
+type vehiclesResponse struct {
+	Data struct {
+		Vehicles []struct {
+			VehicleID string `json:"vehicleId"`
+			Line      struct {
+				LineRef    string `json:"lineRef"`
+				PublicCode string `json:"publicCode"`
+			} `json:"line"`
+			ServiceJourney struct {
+				ID string `json:"id"`
+			} `json:"serviceJourney"`
+			DestinationName string `json:"destinationName"`
+			Location        struct {
+				Latitude  float64 `json:"latitude"`
+				Longitude float64 `json:"longitude"`
+			} `json:"location"`
+			Bearing     float64 `json:"bearing"`
+			Delay       float64 `json:"delay"`
+			LastUpdated string  `json:"lastUpdated"`
+		} `json:"vehicles"`
+	} `json:"data"`
+}
+
+// Vehicles returns the positions of all vehicles operated by AtB.
+func (c *Client) Vehicles(ctx context.Context) ([]Vehicle, error) {
+	const query = `query($codespaceId:String){vehicles(codespaceId:$codespaceId){vehicleId line{lineRef publicCode}serviceJourney{id}destinationName location{latitude longitude}bearing delay lastUpdated}}`
+	url := c.VehiclesURL
+	if url == "" {
+		url = DefaultVehiclesURL
+	}
+	variables := map[string]interface{}{"codespaceId": codespace}
+	body, err := c.queryURL(ctx, url, "entur.Vehicles", query, variables)
+	if err != nil {
+		return nil, err
+	}
+	return parseVehicles(body)
+}
+
+func parseVehicles(jsonData []byte) ([]Vehicle, error) {
+	var r vehiclesResponse
+	if err := json.Unmarshal(jsonData, &r); err != nil {
+		return nil, err
+	}
+	vehicles := make([]Vehicle, 0, len(r.Data.Vehicles))
+	for _, v := range r.Data.Vehicles {
+		lastUpdated, err := time.Parse(time.RFC3339, v.LastUpdated)
+		if err != nil {
+			return nil, err
+		}
+		vehicles = append(vehicles, Vehicle{
+			ID:               v.VehicleID,
+			Line:             v.Line.PublicCode,
+			LineID:           v.Line.LineRef,
+			ServiceJourneyID: v.ServiceJourney.ID,
+			Destination:      v.DestinationName,
+			Latitude:         v.Location.Latitude,
+			Longitude:        v.Location.Longitude,
+			Bearing:          v.Bearing,
+			Delay:            time.Duration(v.Delay * float64(time.Second)),
+			LastUpdated:      lastUpdated,
+		})
+	}
+	return vehicles, nil
+}
@@ -0,0 +1,75 @@
+package gtfsrt
+
+import (
+	"sort"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/mpolden/atb/entur"
+	"google.golang.org/protobuf/proto"
+)
+
+// Version is the GTFS-Realtime version of feeds produced by this package.
+const Version = "2.0"
+
+// TripUpdates creates a GTFS-Realtime feed containing trip updates for given departures. Departures are grouped into
+// trips by their service journey, which corresponds to the trip ID in Entur's GTFS data. Departures without a service
+// journey are ignored. The time now is used as feed timestamp.
+func TripUpdates(departures []entur.Departure, now time.Time) *gtfs.FeedMessage {
+	var tripIDs []string
+	trips := make(map[string][]entur.Departure)
+	for _, d := range departures {
+		if d.ServiceJourneyID == "" {
+			continue
+		}
+		if _, ok := trips[d.ServiceJourneyID]; !ok {
+			tripIDs = append(tripIDs, d.ServiceJourneyID)
+		}
+		trips[d.ServiceJourneyID] = append(trips[d.ServiceJourneyID], d)
+	}
+	entities := make([]*gtfs.FeedEntity, 0, len(tripIDs))
+	for _, id := range tripIDs {
+		calls := trips[id]
+		sort.SliceStable(calls, func(i, j int) bool {
+			return calls[i].ScheduledDepartureTime.Before(calls[j].ScheduledDepartureTime)
+		})
+		updates := make([]*gtfs.TripUpdate_StopTimeUpdate, 0, len(calls))
+		for _, d := range calls {
+			update := &gtfs.TripUpdate_StopTimeUpdate{StopId: proto.String(d.Quay)}
+			if d.IsCancelled {
+				update.ScheduleRelationship = gtfs.TripUpdate_StopTimeUpdate_SKIPPED.Enum()
+			} else if d.IsRealtime {
+				event := &gtfs.TripUpdate_StopTimeEvent{Time: proto.Int64(d.ScheduledDepartureTime.Unix())}
+				if !d.AimedDepartureTime.IsZero() {
+					delay := d.ScheduledDepartureTime.Sub(d.AimedDepartureTime)
+					event.Delay = proto.Int32(int32(delay.Seconds()))
+				}
+				update.Departure = event
+				update.ScheduleRelationship = gtfs.TripUpdate_StopTimeUpdate_SCHEDULED.Enum()
+			} else {
+				update.ScheduleRelationship = gtfs.TripUpdate_StopTimeUpdate_NO_DATA.Enum()
+			}
+			updates = append(updates, update)
+		}
+		trip := &gtfs.TripDescriptor{TripId: proto.String(id)}
+		if lineID := calls[0].LineID; lineID != "" {
+			trip.RouteId = proto.String(lineID)
+		}
+		entities = append(entities, &gtfs.FeedEntity{
+			Id: proto.String(id),
+			TripUpdate: &gtfs.TripUpdate{
+				Trip:           trip,
+				StopTimeUpdate: updates,
+				Timestamp:      proto.Uint64(uint64(now.Unix())),
+			},
+		})
+	}
+	return &gtfs.FeedMessage{
+		Header: &gtfs.FeedHeader{
+			GtfsRealtimeVersion: proto.String(Version),
+			Incrementality:      gtfs.FeedHeader_FULL_DATASET.Enum(),
+			Timestamp:           proto.Uint64(uint64(now.Unix())),
+		},
+		Entity: entities,
+	}
+}
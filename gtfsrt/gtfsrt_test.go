@@ -0,0 +1,108 @@
+package gtfsrt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/mpolden/atb/entur"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTripUpdates(t *testing.T) {
+	cest := time.FixedZone("CEST", 7200)
+	departures := []entur.Departure{
+		{
+			LineID:                 "ATB:Line:2_21",
+			ServiceJourneyID:       "ATB:ServiceJourney:1",
+			Quay:                   "NSR:Quay:73154",
+			AimedDepartureTime:     time.Date(2022, 5, 20, 18, 18, 0, 0, cest),
+			ScheduledDepartureTime: time.Date(2022, 5, 20, 18, 19, 0, 0, cest),
+			IsRealtime:             true,
+		},
+		{
+			LineID:                 "ATB:Line:2_3",
+			ServiceJourneyID:       "ATB:ServiceJourney:2",
+			Quay:                   "NSR:Quay:71184",
+			ScheduledDepartureTime: time.Date(2022, 5, 20, 18, 25, 0, 0, cest),
+		},
+		{
+			LineID:                 "ATB:Line:2_21",
+			ServiceJourneyID:       "ATB:ServiceJourney:1",
+			Quay:                   "NSR:Quay:71181",
+			AimedDepartureTime:     time.Date(2022, 5, 20, 18, 10, 0, 0, cest),
+			ScheduledDepartureTime: time.Date(2022, 5, 20, 18, 10, 30, 0, cest),
+			IsRealtime:             true,
+		},
+		{
+			LineID:                 "ATB:Line:2_3",
+			ServiceJourneyID:       "ATB:ServiceJourney:2",
+			Quay:                   "NSR:Quay:71185",
+			AimedDepartureTime:     time.Date(2022, 5, 20, 18, 27, 0, 0, cest),
+			ScheduledDepartureTime: time.Date(2022, 5, 20, 18, 27, 0, 0, cest),
+			IsRealtime:             true,
+			IsCancelled:            true,
+		},
+		{Line: "4"}, // No service journey
+	}
+	now := time.Date(2022, 5, 20, 18, 0, 0, 0, cest)
+	got := TripUpdates(departures, now)
+	want := &gtfs.FeedMessage{}
+	err := prototext.Unmarshal([]byte(`
+header {
+  gtfs_realtime_version: "2.0"
+  incrementality: FULL_DATASET
+  timestamp: 1653062400
+}
+entity {
+  id: "ATB:ServiceJourney:1"
+  trip_update {
+    trip {
+      trip_id: "ATB:ServiceJourney:1"
+      route_id: "ATB:Line:2_21"
+    }
+    stop_time_update {
+      stop_id: "NSR:Quay:71181"
+      departure {
+        delay: 30
+        time: 1653063030
+      }
+      schedule_relationship: SCHEDULED
+    }
+    stop_time_update {
+      stop_id: "NSR:Quay:73154"
+      departure {
+        delay: 60
+        time: 1653063540
+      }
+      schedule_relationship: SCHEDULED
+    }
+    timestamp: 1653062400
+  }
+}
+entity {
+  id: "ATB:ServiceJourney:2"
+  trip_update {
+    trip {
+      trip_id: "ATB:ServiceJourney:2"
+      route_id: "ATB:Line:2_3"
+    }
+    stop_time_update {
+      stop_id: "NSR:Quay:71184"
+      schedule_relationship: NO_DATA
+    }
+    stop_time_update {
+      stop_id: "NSR:Quay:71185"
+      schedule_relationship: SKIPPED
+    }
+    timestamp: 1653062400
+  }
+}`), want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", prototext.Format(got), prototext.Format(want))
+	}
+}
@@ -0,0 +1,372 @@
+package http
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mpolden/atb/auth"
+	"github.com/mpolden/atb/board"
+	"github.com/mpolden/atb/entur"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+//go:embed board.html
+var boardHTML string
+
+var boardTemplate = template.Must(template.New("board").Parse(boardHTML))
+
+const (
+	defaultBoardRefresh = 30
+	minBoardRefresh     = 10
+	defaultBoardLimit   = 10
+	maxBoardLimit       = 50
+	maxBoardStops       = 10
+)
+
+// Board is a departure board for one or more stops, rendered as an HTML page.
+type Board struct {
+	// Refresh is the number of seconds between page reloads. The page is not reloaded if zero.
+	Refresh int
+	Time    string
+	Stops   []BoardStop
+	Error   string
+}
+
+// BoardStop represents the departures from a single stop on a departure board.
+type BoardStop struct {
+	ID         int
+	Name       string
+	Departures []BoardDeparture
+	Error      string
+}
+
+// BoardDeparture represents a single departure on a departure board.
+type BoardDeparture struct {
+	Departure
+}
+
+func parseBoardStops(s string) ([]board.Stop, error) {
+	var stops []board.Stop
+	for _, v := range strings.Split(s, ",") {
+		stopID, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, board.Stop{ID: stopID})
+	}
+	if len(stops) > maxBoardStops {
+		return nil, fmt.Errorf("too many stops: %d", len(stops))
+	}
+	return stops, nil
+}
+
+func parseLines(values []string) []string {
+	var lines []string
+	for _, v := range values {
+		for _, line := range strings.Split(v, ",") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return lines
+}
+
+func queryInt(r *http.Request, name string, defaultValue, min, max int) (int, *Error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || n > max {
+		return 0, &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid %s: %s", name, v)}
+	}
+	return n, nil
+}
+
+func containsLine(lines []string, line string) bool {
+	if len(lines) == 0 {
+		return true
+	}
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func filterLines(departures []Departure, lines []string) []Departure {
+	if len(lines) == 0 {
+		return departures
+	}
+	filtered := make([]Departure, 0, len(departures))
+	for _, d := range departures {
+		if containsLine(lines, d.LineID) {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// boardStop returns up to limit departures from stopID, going in direction and on one of lines.
+func (s *Server) boardStop(r *http.Request, stopID int, direction string, lines []string, limit int) (BoardStop, time.Time, *Error) {
+	ctx := r.Context()
+	now := s.now()
+	stop, _, err := s.cached(ctx, "stop:"+strconv.Itoa(stopID), s.ttl.stops, func() (interface{}, error) {
+		return s.Source.Stop(ctx, stopID)
+	})
+	if errors.Is(err, entur.ErrNotFound) {
+		return BoardStop{}, now, &Error{err: err, Status: http.StatusNotFound, Message: fmt.Sprintf("Stop not found: %d", stopID)}
+	}
+	boardStop := BoardStop{ID: stopID}
+	if err != nil {
+		infoFromContext(ctx).err = err
+		boardStop.Error = "Failed to get stop from Entur"
+		return boardStop, now, nil
+	}
+	boardStop.Name = stop.(entur.Stop).Name
+	enturDepartures, _, err := s.departures(ctx, stopID)
+	if err != nil {
+		infoFromContext(ctx).err = err
+		boardStop.Error = "Failed to get departures from Entur"
+		return boardStop, now, nil
+	}
+	departures := convertDepartures(enturDepartures, false, now, timeFormatLocal)
+	for _, d := range departures.Departures {
+		if len(boardStop.Departures) == limit {
+			break
+		}
+		if (direction == inbound && !*d.TowardsCentrum) || (direction == outbound && *d.TowardsCentrum) {
+			continue
+		}
+		if !containsLine(lines, d.LineID) {
+			continue
+		}
+		boardStop.Departures = append(boardStop.Departures, BoardDeparture{Departure: d})
+	}
+	// Show time in the same location as departures, which is local to the stop
+	if len(enturDepartures) > 0 {
+		now = now.In(enturDepartures[0].ScheduledDepartureTime.Location())
+	}
+	return boardStop, now, nil
+}
+
+// BoardHandler is a handler which returns a departure board for one or more stops, given as comma-separated stop IDs
+// or the name of a named board.
+func (s *Server) BoardHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "BoardHandler")
+	defer span.End()
+	r = r.WithContext(ctx)
+	name := filepath.Base(r.URL.Path)
+	var stops []board.Stop
+	if named, ok := s.namedBoard(name); ok {
+		stops = named.Stops
+	} else if s.Boards != nil && board.ValidName(name) && !isNumeric(name) {
+		return nil, &Error{Status: http.StatusNotFound, Message: fmt.Sprintf("Board not found: %s", name)}
+	} else {
+		var err error
+		stops, err = parseBoardStops(name)
+		if err != nil {
+			return nil, &Error{
+				err:     err,
+				Status:  http.StatusBadRequest,
+				Message: fmt.Sprintf("Invalid stop IDs. Give up to %d comma-separated stop IDs, e.g. /board/41613,42098.", maxBoardStops),
+			}
+		}
+	}
+	infoFromContext(ctx).stopID = stops[0].ID
+	query := r.URL.Query()
+	direction := query.Get("direction")
+	switch direction {
+	case "", inbound, outbound:
+	default:
+		return nil, &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid direction: %s", direction)}
+	}
+	lines := parseLines(query["line"])
+	refresh, e := queryInt(r, "refresh", defaultBoardRefresh, minBoardRefresh, 3600)
+	if e != nil {
+		return nil, e
+	}
+	limit, e := queryInt(r, "limit", defaultBoardLimit, 1, maxBoardLimit)
+	if e != nil {
+		return nil, e
+	}
+	page := &Board{Refresh: refresh}
+	now := s.now()
+	for i, stop := range stops {
+		// Filters given in the query take precedence over those of a named board
+		stopDirection, stopLines := stop.Direction, stop.Lines
+		if direction != "" {
+			stopDirection = direction
+		}
+		if len(lines) > 0 {
+			stopLines = lines
+		}
+		boardStop, t, e := s.boardStop(r, stop.ID, stopDirection, stopLines, limit)
+		if e != nil {
+			return nil, e
+		}
+		if i == 0 {
+			now = t
+		}
+		page.Stops = append(page.Stops, boardStop)
+	}
+	page.Time = now.Format("15:04")
+	return page, nil
+}
+
+// boardPage returns a handler which renders the departure board returned by next as an HTML page.
+func boardPage(next appHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, e := next(w, r)
+		status := http.StatusOK
+		if e != nil {
+			if e.err != nil {
+				infoFromContext(r.Context()).err = e.err
+			}
+			page := &Board{Error: e.Message}
+			if e.Status == http.StatusTooManyRequests || e.Status >= 500 {
+				// Keep retrying as the error is likely temporary
+				page.Refresh = defaultBoardRefresh
+			}
+			data = page
+			status = e.Status
+		}
+		var buf bytes.Buffer
+		if err := boardTemplate.Execute(&buf, data); err != nil {
+			// Should never happen
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(buf.Bytes())
+	})
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// namedBoard returns the named board with given name, if named boards are enabled.
+func (s *Server) namedBoard(name string) (board.Board, bool) {
+	if s.Boards == nil {
+		return board.Board{}, false
+	}
+	return s.Boards.Get(name)
+}
+
+// requireAdmin returns an error unless the request was made with an admin API key.
+func requireAdmin(r *http.Request) *Error {
+	key, ok := auth.FromContext(r.Context())
+	if !ok {
+		return &Error{Status: http.StatusUnauthorized, Message: "API key required"}
+	}
+	if !key.Admin {
+		return &Error{Status: http.StatusForbidden, Message: "Admin API key required"}
+	}
+	return nil
+}
+
+// NamedBoardHandler is a handler which lists named boards, and retrieves departures for a named board. Admins can
+// create, replace and delete named boards using PUT and DELETE.
+func (s *Server) NamedBoardHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "NamedBoardHandler")
+	defer span.End()
+	if s.Boards == nil {
+		return nil, &Error{Status: http.StatusNotFound, Message: "Named boards are not enabled"}
+	}
+	prefix := urlPrefix(r)
+	name := filepath.Base(r.URL.Path)
+	if name == "boards" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			return nil, &Error{Status: http.StatusMethodNotAllowed, Message: fmt.Sprintf("Method not allowed: %s", r.Method)}
+		}
+		boards := s.Boards.List()
+		named := NamedBoards{URL: fmt.Sprintf("%s/api/v2/boards", prefix), Boards: make([]NamedBoardInfo, 0, len(boards))}
+		for _, b := range boards {
+			named.Boards = append(named.Boards, NamedBoardInfo{URL: fmt.Sprintf("%s/api/v2/boards/%s", prefix, b.Name), Board: b})
+		}
+		return named, nil
+	}
+	span.SetAttributes(attribute.String("atb.board", name))
+	url := fmt.Sprintf("%s/api/v2/boards/%s", prefix, name)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		if e := requireAdmin(r); e != nil {
+			return nil, e
+		}
+		var b board.Board
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&b); err != nil {
+			return nil, &Error{err: err, Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid board: %s", err)}
+		}
+		if b.Name == "" {
+			b.Name = name
+		} else if b.Name != name {
+			return nil, &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid board: name %q does not match %q", b.Name, name)}
+		}
+		if err := b.Validate(); err != nil {
+			return nil, &Error{err: err, Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid board: %s", err)}
+		}
+		if err := s.Boards.Put(b); err != nil {
+			return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to save board"}
+		}
+		return NamedBoardInfo{URL: url, Board: b}, nil
+	case http.MethodDelete:
+		if e := requireAdmin(r); e != nil {
+			return nil, e
+		}
+		b, ok := s.Boards.Get(name)
+		if !ok {
+			return nil, &Error{Status: http.StatusNotFound, Message: "Board not found"}
+		}
+		if _, err := s.Boards.Delete(name); err != nil {
+			return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to save board"}
+		}
+		return NamedBoardInfo{URL: url, Board: b}, nil
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		return nil, &Error{Status: http.StatusMethodNotAllowed, Message: fmt.Sprintf("Method not allowed: %s", r.Method)}
+	}
+	b, ok := s.Boards.Get(name)
+	if !ok {
+		return nil, &Error{Status: http.StatusNotFound, Message: "Board not found"}
+	}
+	tf, e := requestTimeFormat(r)
+	if e != nil {
+		return nil, e
+	}
+	named := NamedBoard{URL: url, Name: b.Name, Stops: make([]NamedBoardStop, 0, len(b.Stops))}
+	allHit := true
+	for _, stop := range b.Stops {
+		departures, hit, err := s.enturDepartures(ctx, prefix, stop.ID, stop.Direction, false, tf)
+		if err != nil {
+			return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get departures from Entur"}
+		}
+		allHit = allHit && hit
+		if named.ServerTime == "" {
+			named.ServerTime = departures.ServerTime
+		}
+		named.Stops = append(named.Stops, NamedBoardStop{
+			URL:        departures.URL,
+			Stop:       stop,
+			Departures: filterLines(departures.Departures, stop.Lines),
+		})
+	}
+	s.setCacheHeader(w, allHit)
+	return named, nil
+}
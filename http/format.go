@@ -0,0 +1,173 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+	formatCSV  = "csv"
+	formatText = "text"
+	formatPB   = "protobuf"
+)
+
+var contentTypes = map[string]string{
+	formatJSON: "application/json",
+	formatXML:  "application/xml; charset=utf-8",
+	formatCSV:  "text/csv; charset=utf-8",
+	formatText: "text/plain; charset=utf-8",
+	formatPB:   "application/x-protobuf",
+}
+
+var mediaTypes = map[string]string{
+	"application/json": formatJSON,
+	"application/xml":  formatXML,
+	"text/xml":         formatXML,
+	"text/csv":         formatCSV,
+	"text/plain":       formatText,
+	"*/*":              formatJSON,
+	"application/*":    formatJSON,
+}
+
+type formatKey struct{}
+
+// fixedFormat returns a handler which always encodes responses from next in given format, regardless of the format
+// requested by the client.
+func fixedFormat(format string, next appHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), formatKey{}, format)))
+	})
+}
+
+// tabular is implemented by response types that can be encoded in formats other than JSON.
+type tabular interface {
+	// table returns the header and rows of a table representing this value. A compact table contains only the most
+	// essential columns.
+	table(compact bool) ([]string, [][]string)
+}
+
+// negotiateFormat returns the response format requested by r, and whether the format was requested explicitly through
+// the format parameter.
+func negotiateFormat(r *http.Request) (string, bool) {
+	if format, ok := r.Context().Value(formatKey{}).(string); ok {
+		return format, true
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format, true
+	}
+	type mediaRange struct {
+		format string
+		q      float64
+	}
+	var ranges []mediaRange
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		parts := strings.Split(v, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		if mediaType == "text/html" {
+			// Browsers prefer XML over anything else we support, but JSON is more useful when browsing the API
+			return formatJSON, false
+		}
+		format, ok := mediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if f, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{format, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	if len(ranges) > 0 {
+		return ranges[0].format, false
+	}
+	return formatJSON, false
+}
+
+func encodeTable(v tabular, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch format {
+	case formatCSV:
+		header, rows := v.table(false)
+		w := csv.NewWriter(&buf)
+		w.Write(header)
+		w.WriteAll(rows)
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	case formatText:
+		header, rows := v.table(true)
+		w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		if err := w.Flush(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported format: %q", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// encode encodes v in given format.
+func encode(v interface{}, format string) ([]byte, error) {
+	switch format {
+	case formatJSON:
+		return json.Marshal(v)
+	case formatXML:
+		out, err := xml.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(xml.Header), out...), nil
+	case formatPB:
+		m, ok := v.(proto.Message)
+		if !ok {
+			return nil, fmt.Errorf("unsupported format: %q", format)
+		}
+		return proto.Marshal(m)
+	}
+	t, ok := v.(tabular)
+	if !ok {
+		return nil, fmt.Errorf("unsupported format: %q", format)
+	}
+	return encodeTable(t, format)
+}
+
+// supportsFormat returns whether v can be encoded in given format.
+func supportsFormat(v interface{}, format string) bool {
+	if _, ok := contentTypes[format]; !ok {
+		return false
+	}
+	switch format {
+	case formatJSON:
+		return true
+	case formatPB:
+		_, ok := v.(proto.Message)
+		return ok
+	}
+	_, ok := v.(tabular)
+	return ok
+}
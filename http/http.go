@@ -1,35 +1,86 @@
 package http
 
 import (
+	"context"
+	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/mpolden/atb/auth"
+	"github.com/mpolden/atb/board"
 	"github.com/mpolden/atb/cache"
+	"github.com/mpolden/atb/direction"
 	"github.com/mpolden/atb/entur"
+	"github.com/mpolden/atb/gtfsrt"
+	"github.com/mpolden/atb/ratelimit"
+	"github.com/mpolden/atb/siri"
+	"github.com/mpolden/atb/source"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	inbound  = "inbound"
 	outbound = "outbound"
+	// journeyConcurrency is the maximum number of service journeys retrieved concurrently when classifying departures.
+	journeyConcurrency = 4
 )
 
+//go:embed openapi.json
+var openAPI []byte
+
 // Server represents an Server server.
 type Server struct {
-	Entur *entur.Client
-	CORS  bool
-	cache *cache.Cache
+	// Source provides departures, stops and situations.
+	Source source.DepartureSource
+	// Planner plans trips between stops. Journey planning is disabled if nil.
+	Planner source.JourneyPlanner
+	// Lines provides information about lines. Line information is disabled if nil.
+	Lines source.LineSource
+	// Vehicles provides vehicle positions. Vehicle positions are disabled if nil.
+	Vehicles source.VehicleSource
+	CORS     bool
+	// RateLimiter limits the number of API requests per client. Rate limiting is disabled if nil.
+	RateLimiter *ratelimit.Limiter
+	// TrustedProxies contains the networks of proxies whose X-Forwarded-For header is trusted when determining the
+	// client address.
+	TrustedProxies []*net.IPNet
+	// FeedStops contains the stops included in the GTFS-Realtime feed.
+	FeedStops []int
+	// Keys contains the API keys accepted by the server. API keys are not used if nil.
+	Keys *auth.Keys
+	// Anonymous controls whether requests without an API key are allowed when Keys is set.
+	Anonymous bool
+	// Directions classifies departures as going towards or away from the city centre. The direction given by Source is
+	// used if nil.
+	Directions *direction.Rules
+	// Boards contains the named boards. Named boards are disabled if nil.
+	Boards *board.Boards
+	// Logger is used for access and error logging. The default logger is used if nil.
+	Logger *slog.Logger
+	cache  *cache.Cache
+	now    func() time.Time
+	// journeyTimeout bounds the time spent retrieving service journeys when classifying departures.
+	journeyTimeout time.Duration
 	ttl
 }
 
 type ttl struct {
 	departures time.Duration
 	stops      time.Duration
+	vehicles   time.Duration
 }
 
 func urlPrefix(r *http.Request) string {
@@ -49,6 +100,43 @@ func urlPrefix(r *http.Request) string {
 	return url.String()
 }
 
+func isTrusted(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrusted(ip, trustedProxies) {
+		return host
+	}
+	// Walk X-Forwarded-For from the right, the first untrusted address is the client
+	var forwardedFor []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		forwardedFor = append(forwardedFor, strings.Split(v, ",")...)
+	}
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwardedFor[i])
+		forwardedIP := net.ParseIP(addr)
+		if forwardedIP == nil {
+			break
+		}
+		host = addr
+		if !isTrusted(forwardedIP, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
 func filterDepartures(departures []Departure, direction string) []Departure {
 	switch direction {
 	case inbound, outbound:
@@ -68,21 +156,124 @@ func filterDepartures(departures []Departure, direction string) []Departure {
 	return departures
 }
 
-func (s *Server) enturDepartures(urlPrefix string, stopID int, direction string) (Departures, bool, error) {
-	cacheKey := strconv.Itoa(stopID)
-	cached, hit := s.cache.Get(cacheKey)
-	var departures Departures
-	if hit {
-		departures = cached.(Departures)
-	} else {
-		enturDepartures, err := s.Entur.Departures(25, stopID)
-		if err != nil {
-			return Departures{}, hit, err
+func (s *Server) cacheGet(ctx context.Context, key string) (interface{}, bool) {
+	_, span := tracer.Start(ctx, "cache.Get", trace.WithAttributes(attribute.String("cache.key", key)))
+	defer span.End()
+	v, hit := s.cache.Get(key)
+	span.SetAttributes(attribute.Bool("cache.hit", hit))
+	return v, hit
+}
+
+// departures returns departures from stopID, either from cache or from the departure source.
+func (s *Server) departures(ctx context.Context, stopID int) ([]entur.Departure, bool, error) {
+	return s.classified(ctx, strconv.Itoa(stopID), func() ([]entur.Departure, error) { return s.Source.Departures(ctx, 25, stopID) })
+}
+
+// classified returns the departures stored in cache under key, or the departures returned by fetch, classified by
+// s.classify. Only the time spent in fetch is recorded as upstream latency.
+func (s *Server) classified(ctx context.Context, key string, fetch func() ([]entur.Departure, error)) ([]entur.Departure, bool, error) {
+	if cached, hit := s.cacheGet(ctx, key); hit {
+		return cached.([]entur.Departure), true, nil
+	}
+	start := time.Now()
+	departures, err := fetch()
+	infoFromContext(ctx).upstream += time.Since(start)
+	if err != nil {
+		return nil, false, err
+	}
+	departures = s.classify(ctx, departures)
+	s.cache.Set(key, departures, s.ttl.departures)
+	return departures, false, nil
+}
+
+// cached returns the value stored in cache under key, or the value returned by fetch. Values returned by fetch are
+// cached for given TTL.
+func (s *Server) cached(ctx context.Context, key string, ttl time.Duration, fetch func() (interface{}, error)) (interface{}, bool, error) {
+	if cached, hit := s.cacheGet(ctx, key); hit {
+		return cached, true, nil
+	}
+	start := time.Now()
+	v, err := fetch()
+	infoFromContext(ctx).upstream += time.Since(start)
+	if err != nil {
+		return nil, false, err
+	}
+	s.cache.Set(key, v, ttl)
+	return v, false, nil
+}
+
+// journey returns the service journey identified by id, either from cache or from the journey planner.
+func (s *Server) journey(ctx context.Context, id string) (entur.ServiceJourney, bool, error) {
+	v, hit, err := s.cached(ctx, "journey:"+id, s.ttl.departures, func() (interface{}, error) { return s.Planner.ServiceJourney(ctx, id) })
+	if err != nil {
+		return entur.ServiceJourney{}, false, err
+	}
+	return v.(entur.ServiceJourney), hit, nil
+}
+
+// classify returns a copy of departures where the direction of each departure is set according to s.Directions. The
+// remaining stops of a departure's journey are only retrieved if the journey planner is enabled and the departure does
+// not come from the timetable. Journeys are retrieved concurrently, and retrieval is bounded by s.journeyTimeout.
+func (s *Server) classify(ctx context.Context, departures []entur.Departure) []entur.Departure {
+	if s.Directions == nil {
+		return departures
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.journeyTimeout)
+	defer cancel()
+	classified := make([]entur.Departure, len(departures))
+	copy(classified, departures)
+	sem := make(chan struct{}, journeyConcurrency)
+	var wg sync.WaitGroup
+	for i := range classified {
+		d := &classified[i]
+		var calls func() ([]entur.Call, error)
+		// Departures from the timetable are only returned when Entur is unavailable, so asking Entur for their
+		// journeys would only add latency
+		if s.Planner != nil && !d.Timetable {
+			id := d.ServiceJourneyID
+			// Journeys are retrieved concurrently, so each retrieval records its details in a separate request info
+			ctx := context.WithValue(ctx, requestInfoKey{}, &requestInfo{})
+			calls = func() ([]entur.Call, error) {
+				journey, _, err := s.journey(ctx, id)
+				if err != nil {
+					s.logger().WarnContext(ctx, "failed to get service journey, using direction from source", "serviceJourneyId", id, "error", err)
+					return nil, err
+				}
+				return journey.Calls, nil
+			}
 		}
-		departures = convertDepartures(enturDepartures)
-		departures.URL = fmt.Sprintf("%s/api/v2/departures/%d", urlPrefix, stopID)
-		s.cache.Set(cacheKey, departures, s.ttl.departures)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			d.Inbound = s.Directions.Inbound(*d, calls)
+		}()
 	}
+	wg.Wait()
+	return classified
+}
+
+// arrivals returns arrivals at stopID, either from cache or from the departure source.
+func (s *Server) arrivals(ctx context.Context, stopID int) ([]entur.Departure, bool, error) {
+	return s.classified(ctx, "arrivals:"+strconv.Itoa(stopID), func() ([]entur.Departure, error) { return s.Source.Arrivals(ctx, 25, stopID) })
+}
+
+func (s *Server) enturDepartures(ctx context.Context, urlPrefix string, stopID int, direction string, arrivals bool, tf timeFormat) (Departures, bool, error) {
+	ctx, span := tracer.Start(ctx, "enturDepartures", trace.WithAttributes(attribute.Int("atb.stop_id", stopID), attribute.Bool("atb.arrivals", arrivals)))
+	defer span.End()
+	get := s.departures
+	if arrivals {
+		get = s.arrivals
+	}
+	enturDepartures, hit, err := get(ctx, stopID)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return Departures{}, hit, err
+	}
+	departures := convertDepartures(enturDepartures, arrivals, s.now(), tf)
+	departures.URL = fmt.Sprintf("%s/api/v2/departures/%d", urlPrefix, stopID)
 	departures.Departures = filterDepartures(departures.Departures, direction)
 	return departures, hit, nil
 }
@@ -97,6 +288,8 @@ func (s *Server) setCacheHeader(w http.ResponseWriter, hit bool) {
 
 // DepartureHandlerV2 is a handler which retrieves departures for a given bus stop through Entur.
 func (s *Server) DepartureHandlerV2(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "DepartureHandlerV2")
+	defer span.End()
 	stopID, err := strconv.Atoi(filepath.Base(r.URL.Path))
 	if err != nil {
 		return nil, &Error{
@@ -105,8 +298,21 @@ func (s *Server) DepartureHandlerV2(w http.ResponseWriter, r *http.Request) (int
 			Message: "Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs.",
 		}
 	}
-	direction := r.URL.Query().Get("direction")
-	departures, hit, err := s.enturDepartures(urlPrefix(r), stopID, direction)
+	infoFromContext(ctx).stopID = stopID
+	query := r.URL.Query()
+	arrivals := false
+	switch t := query.Get("type"); t {
+	case "", "departures":
+	case "arrivals":
+		arrivals = true
+	default:
+		return nil, &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid type: %s", t)}
+	}
+	tf, e := requestTimeFormat(r)
+	if e != nil {
+		return nil, e
+	}
+	departures, hit, err := s.enturDepartures(ctx, urlPrefix(r), stopID, query.Get("direction"), arrivals, tf)
 	if err != nil {
 		return nil, &Error{
 			err:     err,
@@ -118,6 +324,342 @@ func (s *Server) DepartureHandlerV2(w http.ResponseWriter, r *http.Request) (int
 	return departures, nil
 }
 
+// DepartureHandlerV3 is a handler which retrieves departures, stop information and situations for a given stop.
+func (s *Server) DepartureHandlerV3(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "DepartureHandlerV3")
+	defer span.End()
+	stopID, err := strconv.Atoi(filepath.Base(r.URL.Path))
+	if err != nil {
+		return nil, &Error{
+			err:     err,
+			Status:  http.StatusBadRequest,
+			Message: "Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs.",
+		}
+	}
+	infoFromContext(ctx).stopID = stopID
+	query := r.URL.Query()
+	direction := query.Get("direction")
+	switch direction {
+	case "", inbound, outbound:
+	default:
+		return nil, &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid direction: %s", direction)}
+	}
+	get := s.departures
+	switch t := query.Get("type"); t {
+	case "", "departures":
+	case "arrivals":
+		get = s.arrivals
+	default:
+		return nil, &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid type: %s", t)}
+	}
+	stop, _, err := s.cached(ctx, "stop:"+strconv.Itoa(stopID), s.ttl.stops, func() (interface{}, error) {
+		return s.Source.Stop(ctx, stopID)
+	})
+	if errors.Is(err, entur.ErrNotFound) {
+		return nil, &Error{err: err, Status: http.StatusNotFound, Message: "Stop not found"}
+	} else if err != nil {
+		return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get stop from Entur"}
+	}
+	departures, hit, err := get(ctx, stopID)
+	if err != nil {
+		return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get departures from Entur"}
+	}
+	situations, _, err := s.cached(ctx, "situations:"+strconv.Itoa(stopID), s.ttl.departures, func() (interface{}, error) {
+		return s.Source.Situations(ctx, stopID)
+	})
+	if err != nil {
+		return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get situations from Entur"}
+	}
+	response := convertDeparturesV3(stop.(entur.Stop), departures, situations.([]entur.Situation), direction, s.now().Truncate(time.Second))
+	response.URL = fmt.Sprintf("%s/api/v3/departures/%d", urlPrefix(r), stopID)
+	s.setCacheHeader(w, hit)
+	return response, nil
+}
+
+// requestTimeFormat returns the time format requested by the timeFormat parameter.
+func requestTimeFormat(r *http.Request) (timeFormat, *Error) {
+	v := r.URL.Query().Get("timeFormat")
+	tf, ok := parseTimeFormat(v)
+	if !ok {
+		return "", &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid timeFormat: %s", v)}
+	}
+	return tf, nil
+}
+
+func parseStopRef(ref string) (int, error) {
+	const prefix = "NSR:StopPlace:"
+	return strconv.Atoi(strings.TrimPrefix(ref, prefix))
+}
+
+// StopMonitoringHandler is a handler which retrieves departures for a given stop through Entur and returns them as a
+// SIRI StopMonitoringDelivery.
+func (s *Server) StopMonitoringHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "StopMonitoringHandler")
+	defer span.End()
+	query := r.URL.Query()
+	stopID, err := parseStopRef(query.Get("MonitoringRef"))
+	if err != nil {
+		return nil, &Error{
+			err:     err,
+			Status:  http.StatusBadRequest,
+			Message: "Invalid MonitoringRef. Use https://stoppested.entur.org/ to find stop IDs.",
+		}
+	}
+	maxVisits := 0
+	if v := query.Get("MaximumStopVisits"); v != "" {
+		maxVisits, err = strconv.Atoi(v)
+		if err != nil || maxVisits < 0 {
+			return nil, &Error{err: err, Status: http.StatusBadRequest, Message: "Invalid MaximumStopVisits"}
+		}
+	}
+	infoFromContext(ctx).stopID = stopID
+	departures, hit, err := s.departures(ctx, stopID)
+	if err != nil {
+		return nil, &Error{
+			err:     err,
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to get departures from Entur",
+		}
+	}
+	lineRef := query.Get("LineRef")
+	filtered := make([]entur.Departure, 0, len(departures))
+	for _, d := range departures {
+		if lineRef != "" && lineRef != d.LineID && lineRef != d.Line {
+			continue
+		}
+		if maxVisits > 0 && len(filtered) == maxVisits {
+			break
+		}
+		filtered = append(filtered, d)
+	}
+	s.setCacheHeader(w, hit)
+	return siri.StopMonitoring(fmt.Sprintf("NSR:StopPlace:%d", stopID), filtered, s.now()), nil
+}
+
+// TripUpdatesHandler is a handler which returns a GTFS-Realtime feed of trip updates for departures from the
+// configured feed stops.
+func (s *Server) TripUpdatesHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "TripUpdatesHandler")
+	defer span.End()
+	if len(s.FeedStops) == 0 {
+		return nil, &Error{Status: http.StatusNotFound, Message: "No stops are configured for the GTFS-Realtime feed"}
+	}
+	var departures []entur.Departure
+	for _, stopID := range s.FeedStops {
+		stopDepartures, _, err := s.departures(ctx, stopID)
+		if err != nil {
+			return nil, &Error{
+				err:     err,
+				Status:  http.StatusInternalServerError,
+				Message: "Failed to get departures from Entur",
+			}
+		}
+		departures = append(departures, stopDepartures...)
+	}
+	return gtfsrt.TripUpdates(departures, s.now()), nil
+}
+
+// TripHandler is a handler which suggests trips between two stops.
+func (s *Server) TripHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "TripHandler")
+	defer span.End()
+	if s.Planner == nil {
+		return nil, &Error{Status: http.StatusNotFound, Message: "Journey planning is not enabled"}
+	}
+	query := r.URL.Query()
+	fromID, err := strconv.Atoi(query.Get("from"))
+	if err != nil || fromID < 0 {
+		return nil, &Error{
+			err:     err,
+			Status:  http.StatusBadRequest,
+			Message: "Invalid from stop ID. Use https://stoppested.entur.org/ to find stop IDs.",
+		}
+	}
+	toID, err := strconv.Atoi(query.Get("to"))
+	if err != nil || toID < 0 {
+		return nil, &Error{
+			err:     err,
+			Status:  http.StatusBadRequest,
+			Message: "Invalid to stop ID. Use https://stoppested.entur.org/ to find stop IDs.",
+		}
+	}
+	t := s.now()
+	if v := query.Get("time"); v != "" {
+		t, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, &Error{err: err, Status: http.StatusBadRequest, Message: "Invalid time. Use RFC 3339 format, e.g. 2022-05-20T18:00:00+02:00"}
+		}
+	}
+	arriveBy := false
+	if v := query.Get("arriveBy"); v != "" {
+		arriveBy, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, &Error{err: err, Status: http.StatusBadRequest, Message: "Invalid arriveBy"}
+		}
+	}
+	tf, e := requestTimeFormat(r)
+	if e != nil {
+		return nil, e
+	}
+	span.SetAttributes(attribute.Int("atb.from_stop_id", fromID), attribute.Int("atb.to_stop_id", toID))
+	infoFromContext(ctx).stopID = fromID
+	start := time.Now()
+	enturTrips, err := s.Planner.Trips(ctx, fromID, toID, t, arriveBy)
+	infoFromContext(ctx).upstream += time.Since(start)
+	if err != nil {
+		return nil, &Error{
+			err:     err,
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to get trips from Entur",
+		}
+	}
+	trips := convertTrips(enturTrips, tf)
+	trips.URL = fmt.Sprintf("%s/api/v2/trips?from=%d&to=%d", urlPrefix(r), fromID, toID)
+	return trips, nil
+}
+
+// JourneyHandler is a handler which lists all calls of a service journey.
+func (s *Server) JourneyHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "JourneyHandler")
+	defer span.End()
+	if s.Planner == nil {
+		return nil, &Error{Status: http.StatusNotFound, Message: "Journey planning is not enabled"}
+	}
+	id := filepath.Base(r.URL.Path)
+	if id == "journeys" {
+		return nil, &Error{Status: http.StatusBadRequest, Message: "Missing service journey ID"}
+	}
+	tf, e := requestTimeFormat(r)
+	if e != nil {
+		return nil, e
+	}
+	span.SetAttributes(attribute.String("atb.service_journey_id", id))
+	sj, hit, err := s.journey(ctx, id)
+	if errors.Is(err, entur.ErrNotFound) {
+		return nil, &Error{err: err, Status: http.StatusNotFound, Message: "Service journey not found"}
+	} else if err != nil {
+		return nil, &Error{
+			err:     err,
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to get service journey from Entur",
+		}
+	}
+	s.setCacheHeader(w, hit)
+	journey := convertJourney(sj, tf)
+	journey.URL = fmt.Sprintf("%s/api/v2/journeys/%s", urlPrefix(r), id)
+	return journey, nil
+}
+
+// LineHandler is a handler which lists all lines, or shows a single line and its routes.
+func (s *Server) LineHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "LineHandler")
+	defer span.End()
+	if s.Lines == nil {
+		return nil, &Error{Status: http.StatusNotFound, Message: "Line information is not enabled"}
+	}
+	prefix := urlPrefix(r)
+	publicCode := filepath.Base(r.URL.Path)
+	if publicCode == "lines" {
+		v, hit, err := s.cached(ctx, "lines", s.ttl.stops, func() (interface{}, error) { return s.Lines.Lines(ctx) })
+		if err != nil {
+			return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get lines from Entur"}
+		}
+		s.setCacheHeader(w, hit)
+		enturLines := v.([]entur.Line)
+		lines := Lines{URL: fmt.Sprintf("%s/api/v2/lines", prefix), Lines: make([]Line, 0, len(enturLines))}
+		for _, l := range enturLines {
+			line := convertLine(l)
+			line.URL = fmt.Sprintf("%s/api/v2/lines/%s", prefix, l.PublicCode)
+			lines.Lines = append(lines.Lines, line)
+		}
+		return lines, nil
+	}
+	span.SetAttributes(attribute.String("atb.line", publicCode))
+	v, hit, err := s.cached(ctx, "line:"+publicCode, s.ttl.stops, func() (interface{}, error) { return s.Lines.Line(ctx, publicCode) })
+	if errors.Is(err, entur.ErrNotFound) {
+		return nil, &Error{err: err, Status: http.StatusNotFound, Message: "Line not found"}
+	} else if err != nil {
+		return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get line from Entur"}
+	}
+	s.setCacheHeader(w, hit)
+	line := convertLine(v.(entur.Line))
+	line.URL = fmt.Sprintf("%s/api/v2/lines/%s", prefix, publicCode)
+	return line, nil
+}
+
+// VehicleHandler is a handler which lists vehicle positions, optionally limited to a line or to vehicles approaching
+// a stop.
+func (s *Server) VehicleHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	ctx, span := tracer.Start(r.Context(), "VehicleHandler")
+	defer span.End()
+	if s.Vehicles == nil {
+		return nil, &Error{Status: http.StatusNotFound, Message: "Vehicle positions are not enabled"}
+	}
+	tf, e := requestTimeFormat(r)
+	if e != nil {
+		return nil, e
+	}
+	query := r.URL.Query()
+	var journeys map[string]bool
+	if v := query.Get("stop"); v != "" {
+		stopID, err := strconv.Atoi(v)
+		if err != nil || stopID < 0 {
+			return nil, &Error{
+				err:     err,
+				Status:  http.StatusBadRequest,
+				Message: "Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs.",
+			}
+		}
+		infoFromContext(ctx).stopID = stopID
+		departures, _, err := s.departures(ctx, stopID)
+		if err != nil {
+			return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get departures from Entur"}
+		}
+		journeys = make(map[string]bool, len(departures))
+		for _, d := range departures {
+			journeys[d.ServiceJourneyID] = true
+		}
+	}
+	// Entur returns all vehicles in the codespace, so a short-lived cache is shared by all requests
+	v, _, err := s.cached(ctx, "vehicles", s.ttl.vehicles, func() (interface{}, error) { return s.Vehicles.Vehicles(ctx) })
+	if err != nil {
+		return nil, &Error{err: err, Status: http.StatusInternalServerError, Message: "Failed to get vehicles from Entur"}
+	}
+	enturVehicles := v.([]entur.Vehicle)
+	line := query.Get("line")
+	vehicles := Vehicles{
+		URL:      fmt.Sprintf("%s/api/v2/vehicles", urlPrefix(r)),
+		Vehicles: make([]Vehicle, 0, len(enturVehicles)),
+	}
+	for _, v := range enturVehicles {
+		if line != "" && line != v.Line && line != v.LineID {
+			continue
+		}
+		if journeys != nil && !journeys[v.ServiceJourneyID] {
+			continue
+		}
+		vehicles.Vehicles = append(vehicles.Vehicles, convertVehicle(v, tf))
+	}
+	return vehicles, nil
+}
+
+// UsageHandler shows usage of the API key used in the request.
+func (s *Server) UsageHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	if s.Keys == nil {
+		return nil, &Error{Status: http.StatusNotFound, Message: "API keys are not enabled"}
+	}
+	key, ok := auth.FromContext(r.Context())
+	if !ok {
+		return nil, &Error{Status: http.StatusUnauthorized, Message: "API key required"}
+	}
+	return key.Usage(), nil
+}
+
+// OpenAPIHandler serves the OpenAPI specification of the API.
+func (s *Server) OpenAPIHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+	return json.RawMessage(openAPI), nil
+}
+
 // DefaultHandler lists known URLs.
 func (s *Server) DefaultHandler(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
 	if r.URL.Path != "/" {
@@ -125,24 +667,37 @@ func (s *Server) DefaultHandler(w http.ResponseWriter, r *http.Request) (interfa
 	}
 	prefix := urlPrefix(r)
 	departuresV2URL := fmt.Sprintf("%s/api/v2/departures", prefix)
+	tripsURL := fmt.Sprintf("%s/api/v2/trips", prefix)
+	journeysURL := fmt.Sprintf("%s/api/v2/journeys", prefix)
+	linesURL := fmt.Sprintf("%s/api/v2/lines", prefix)
+	vehiclesURL := fmt.Sprintf("%s/api/v2/vehicles", prefix)
+	boardsURL := fmt.Sprintf("%s/api/v2/boards", prefix)
+	departuresV3URL := fmt.Sprintf("%s/api/v3/departures", prefix)
+	stopMonitoringURL := fmt.Sprintf("%s/siri/stop-monitoring", prefix)
+	tripUpdatesURL := fmt.Sprintf("%s/gtfs-rt/trip-updates", prefix)
+	boardURL := fmt.Sprintf("%s/board", prefix)
+	openAPIURL := fmt.Sprintf("%s/openapi.json", prefix)
 	return struct {
 		URLs []string `json:"urls"`
 	}{
-		[]string{departuresV2URL},
+		[]string{departuresV2URL, tripsURL, journeysURL, linesURL, vehiclesURL, boardsURL, departuresV3URL, stopMonitoringURL, tripUpdatesURL, boardURL, openAPIURL},
 	}, nil
 }
 
-// New returns a new Server using given clients to communicate with AtB and Entur. stopTTL and departureTTL control the
-// cache TTL bus stops and departures.
-func New(entur *entur.Client, stopTTL, departureTTL time.Duration, cors bool) *Server {
+// New returns a new Server retrieving departures from source. stopTTL and departureTTL control the cache TTL bus stops
+// and departures.
+func New(source source.DepartureSource, stopTTL, departureTTL time.Duration, cors bool) *Server {
 	cache := cache.New(time.Minute)
 	return &Server{
-		Entur: entur,
-		CORS:  cors,
-		cache: cache,
+		Source:         source,
+		CORS:           cors,
+		cache:          cache,
+		now:            time.Now,
+		journeyTimeout: 2 * time.Second,
 		ttl: ttl{
 			stops:      stopTTL,
 			departures: departureTTL,
+			vehicles:   10 * time.Second,
 		},
 	}
 }
@@ -150,33 +705,114 @@ func New(entur *entur.Client, stopTTL, departureTTL time.Duration, cors bool) *S
 type appHandler func(http.ResponseWriter, *http.Request) (interface{}, *Error)
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	data, e := fn(w, r)
+	w.Header().Add("Vary", "Accept")
+	format, explicit := negotiateFormat(r)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Requests with side effects always get a JSON response, so that an unsupported format cannot fail the
+		// request after its side effects have happened
+		format, explicit = formatJSON, false
+	}
+	_, fixed := r.Context().Value(formatKey{}).(string)
+	var data interface{}
+	var e *Error
+	if _, ok := contentTypes[format]; !ok {
+		e = &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("Invalid format: %s", format)}
+	} else {
+		data, e = fn(w, r)
+	}
+	if e == nil && !fixed && !supportsFormat(data, format) {
+		if explicit {
+			e = &Error{Status: http.StatusNotAcceptable, Message: fmt.Sprintf("Format %s is not supported by this resource", format)}
+		}
+		format = formatJSON
+	}
+	status := http.StatusOK
 	if e != nil { // e is *Error, not os.Error.
 		if e.err != nil {
-			log.Print(e.err)
+			infoFromContext(r.Context()).err = e.err
 		}
-		out, err := json.Marshal(e)
-		if err != nil {
-			// Should never happen
-			panic(err)
+		if !supportsFormat(e, format) {
+			format = formatJSON
 		}
-		w.WriteHeader(e.Status)
-		w.Write(out)
-	} else {
-		out, err := json.Marshal(data)
-		if err != nil {
-			panic(err)
+		data = e
+		status = e.Status
+	}
+	out, err := encode(data, format)
+	if err != nil {
+		// Should never happen
+		panic(err)
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("apiKey")
+}
+
+func (s *Server) authenticate(r *http.Request) (*auth.Key, *Error) {
+	if s.Keys == nil {
+		return nil, nil
+	}
+	v := requestKey(r)
+	if v == "" {
+		if s.Anonymous {
+			return nil, nil
+		}
+		return nil, &Error{Status: http.StatusUnauthorized, Message: "API key required"}
+	}
+	key, ok := s.Keys.Lookup(v)
+	if !ok {
+		return nil, &Error{Status: http.StatusUnauthorized, Message: "Invalid API key"}
+	}
+	if key.Disabled {
+		return nil, &Error{Status: http.StatusForbidden, Message: "API key is disabled"}
+	}
+	return key, nil
+}
+
+func (s *Server) protect(next appHandler) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, *Error) {
+		key, e := s.authenticate(r)
+		ok, wait := true, time.Duration(0)
+		switch {
+		case e != nil:
+			// Failed authentication is limited per address, so that keys cannot be guessed at an unlimited rate
+			if s.RateLimiter != nil {
+				ok, wait = s.RateLimiter.Allow(clientIP(r, s.TrustedProxies))
+			}
+		case key != nil:
+			ok, wait = key.Allow(s.RateLimiter, clientIP(r, s.TrustedProxies))
+			r = r.WithContext(auth.NewContext(r.Context(), key))
+		case s.RateLimiter != nil:
+			ok, wait = s.RateLimiter.Allow(clientIP(r, s.TrustedProxies))
 		}
-		w.Write(out)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return nil, &Error{Status: http.StatusTooManyRequests, Message: "Too many requests"}
+		}
+		if e != nil {
+			return nil, e
+		}
+		return next(w, r)
 	}
 }
 
 func requestFilter(next http.Handler, cors bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
 		if cors {
-			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE")
 			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Headers", "X-API-Key, Content-Type")
+			if r.Method == http.MethodOptions {
+				// Preflight request
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
 		}
 		next.ServeHTTP(w, r)
 	})
@@ -185,10 +821,25 @@ func requestFilter(next http.Handler, cors bool) http.Handler {
 // Handler returns a root handler for the API.
 func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/api/v2/departures", appHandler(s.DepartureHandlerV2))
-	mux.Handle("/api/v2/departures/", appHandler(s.DepartureHandlerV2))
+	mux.Handle("/api/v2/departures", s.protect(s.DepartureHandlerV2))
+	mux.Handle("/api/v2/departures/", s.protect(s.DepartureHandlerV2))
+	mux.Handle("/api/v2/trips", s.protect(s.TripHandler))
+	mux.Handle("/api/v2/journeys", s.protect(s.JourneyHandler))
+	mux.Handle("/api/v2/journeys/", s.protect(s.JourneyHandler))
+	mux.Handle("/api/v2/lines", s.protect(s.LineHandler))
+	mux.Handle("/api/v2/lines/", s.protect(s.LineHandler))
+	mux.Handle("/api/v2/vehicles", s.protect(s.VehicleHandler))
+	mux.Handle("/api/v2/usage", s.protect(s.UsageHandler))
+	mux.Handle("/api/v2/boards", s.protect(s.NamedBoardHandler))
+	mux.Handle("/api/v2/boards/", s.protect(s.NamedBoardHandler))
+	mux.Handle("/api/v3/departures", s.protect(s.DepartureHandlerV3))
+	mux.Handle("/api/v3/departures/", s.protect(s.DepartureHandlerV3))
+	mux.Handle("/siri/stop-monitoring", fixedFormat(formatXML, s.protect(s.StopMonitoringHandler)))
+	mux.Handle("/gtfs-rt/trip-updates", fixedFormat(formatPB, s.protect(s.TripUpdatesHandler)))
+	mux.Handle("/board/", boardPage(s.protect(s.BoardHandler)))
+	mux.Handle("/openapi.json", appHandler(s.OpenAPIHandler))
 	mux.Handle("/", appHandler(s.DefaultHandler))
-	return requestFilter(mux, s.CORS)
+	return traceRequests(s.logRequests(requestFilter(mux, s.CORS)), mux)
 }
 
 // ListenAndServe listens on the TCP network address addr and serves the API.
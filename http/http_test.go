@@ -1,16 +1,39 @@
 package http
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/MobilityData/gtfs-realtime-bindings/golang/gtfs"
+	"github.com/mpolden/atb/auth"
+	"github.com/mpolden/atb/board"
+	"github.com/mpolden/atb/direction"
 	"github.com/mpolden/atb/entur"
+	"github.com/mpolden/atb/ratelimit"
+	"github.com/mpolden/atb/source"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/protobuf/proto"
 )
 
 func apiTestServer() *httptest.Server {
@@ -27,9 +50,31 @@ func testServers() (*httptest.Server, *Server) {
 	apiServer := apiTestServer()
 	entur := &entur.Client{URL: apiServer.URL}
 	server := New(entur, 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2021, 8, 11, 23, 30, 0, 0, time.FixedZone("CEST", 2*60*60)) }
 	return apiServer, server
 }
 
+func urlsResponse(prefix string) string {
+	paths := []string{
+		"/api/v2/departures",
+		"/api/v2/trips",
+		"/api/v2/journeys",
+		"/api/v2/lines",
+		"/api/v2/vehicles",
+		"/api/v2/boards",
+		"/api/v3/departures",
+		"/siri/stop-monitoring",
+		"/gtfs-rt/trip-updates",
+		"/board",
+		"/openapi.json",
+	}
+	urls := make([]string, 0, len(paths))
+	for _, p := range paths {
+		urls = append(urls, fmt.Sprintf("%q", prefix+p))
+	}
+	return `{"urls":[` + strings.Join(urls, ",") + `]}`
+}
+
 func httpGet(url string) (string, string, int, error) {
 	res, err := http.Get(url)
 	if err != nil {
@@ -58,12 +103,12 @@ func TestAPI(t *testing.T) {
 		// Unknown resources
 		{"/not-found", `{"status":404,"message":"Resource not found"}`, 404},
 		// List know URLs
-		{"/", fmt.Sprintf(`{"urls":["%s/api/v2/departures"]}`, httpSrv.URL), 200},
+		{"/", urlsResponse(httpSrv.URL), 200},
 		// Show specific departure (v2)
 		{"/api/v2/departures", `{"status":400,"message":"Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs."}`, 400},
 		{"/api/v2/departures/", `{"status":400,"message":"Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs."}`, 400},
-		{"/api/v2/departures/60890", fmt.Sprintf(`{"url":"%s/api/v2/departures/60890","departures":[{"line":"11","scheduledDepartureTime":"2021-08-11T23:33:09.000","destination":"Risvollan via sentrum","isRealtimeData":true,"isGoingTowardsCentrum":false},{"line":"3","scheduledDepartureTime":"2021-08-11T23:38:01.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true}]}`, httpSrv.URL), 200},
-		{"/api/v2/departures/60890?direction=inbound", fmt.Sprintf(`{"url":"%s/api/v2/departures/60890","departures":[{"line":"3","scheduledDepartureTime":"2021-08-11T23:38:01.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/60890", fmt.Sprintf(`{"url":"%s/api/v2/departures/60890","serverTime":"2021-08-11T23:30:00.000","departures":[{"line":"11","scheduledDepartureTime":"2021-08-11T23:33:09.000","destination":"Risvollan via sentrum","isRealtimeData":true,"isGoingTowardsCentrum":false,"serviceJourneyId":"ATB:ServiceJourney:11_210811","secondsUntilDeparture":189,"minutesUntilDeparture":3,"displayTime":"3 min"},{"line":"3","scheduledDepartureTime":"2021-08-11T23:38:01.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true,"serviceJourneyId":"ATB:ServiceJourney:3_210811","secondsUntilDeparture":481,"minutesUntilDeparture":8,"displayTime":"8 min"}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/60890?direction=inbound", fmt.Sprintf(`{"url":"%s/api/v2/departures/60890","serverTime":"2021-08-11T23:30:00.000","departures":[{"line":"3","scheduledDepartureTime":"2021-08-11T23:38:01.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true,"serviceJourneyId":"ATB:ServiceJourney:3_210811","secondsUntilDeparture":481,"minutesUntilDeparture":8,"displayTime":"8 min"}]}`, httpSrv.URL), 200},
 	}
 	for _, tt := range tests {
 		data, contentType, status, err := httpGet(httpSrv.URL + tt.url)
@@ -101,6 +146,1403 @@ func TestURLPrefix(t *testing.T) {
 	}
 }
 
+func TestRateLimit(t *testing.T) {
+	apiServer, server := testServers()
+	server.RateLimiter = ratelimit.New(0.5, 2, time.Minute)
+	httpSrv := httptest.NewServer(server.Handler())
+	defer apiServer.Close()
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url        string
+		status     int
+		retryAfter string
+	}{
+		{"/api/v2/departures/60890", 200, ""},
+		{"/api/v2/departures/60890", 200, ""},
+		{"/api/v2/departures/60890", 429, "2"},
+		{"/", 200, ""}, // Not rate limited
+	}
+	for _, tt := range tests {
+		res, err := http.Get(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, got)
+		}
+		if got := res.Header.Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("want Retry-After %q for %s, got %q", tt.retryAfter, tt.url, got)
+		}
+		if tt.status == 429 {
+			want := `{"status":429,"message":"Too many requests"}`
+			if got := string(data); got != want {
+				t.Errorf("want response %s for %s, got %s", want, tt.url, got)
+			}
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	apiServer, server := testServers()
+	keys, err := auth.Parse([]byte(`{"keys":[{"key":"k1","name":"foo"},{"key":"k2","name":"bar","disabled":true},{"key":"k3","name":"baz","rate":0.5,"burst":1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Keys = keys
+	httpSrv := httptest.NewServer(server.Handler())
+	defer apiServer.Close()
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url       string
+		key       string
+		anonymous bool
+		response  string
+		status    int
+	}{
+		{"/api/v2/departures/60890", "", false, `{"status":401,"message":"API key required"}`, 401},
+		{"/api/v2/departures/60890", "k4", false, `{"status":401,"message":"Invalid API key"}`, 401},
+		{"/api/v2/departures/60890?apiKey=k4", "", false, `{"status":401,"message":"Invalid API key"}`, 401},
+		{"/api/v2/departures/60890", "k2", false, `{"status":403,"message":"API key is disabled"}`, 403},
+		{"/api/v2/departures/60890", "k1", false, "", 200},
+		{"/api/v2/departures/60890?apiKey=k1", "", false, "", 200},
+		{"/api/v2/departures/60890", "", true, "", 200},
+		{"/api/v2/departures/60890", "k3", false, "", 200},
+		{"/api/v2/departures/60890", "k3", false, `{"status":429,"message":"Too many requests"}`, 429},
+		{"/api/v2/usage", "", true, `{"status":401,"message":"API key required"}`, 401},
+		{"/api/v2/usage", "k1", false, `{"name":"foo","requests":3,"rejected":0,"lastUsed":`, 200},
+		{"/", "", false, "", 200},
+	}
+	for _, tt := range tests {
+		server.Anonymous = tt.anonymous
+		req, err := http.NewRequest("GET", httpSrv.URL+tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("want status %d for %s (key %q), got %d", tt.status, tt.url, tt.key, got)
+		}
+		if got := string(data); !strings.HasPrefix(got, tt.response) {
+			t.Errorf("want response %s for %s (key %q), got %s", tt.response, tt.url, tt.key, got)
+		}
+	}
+}
+
+func TestAuthRateLimit(t *testing.T) {
+	apiServer, server := testServers()
+	keys, err := auth.Parse([]byte(`{"keys":[{"key":"k1","name":"foo"},{"key":"k2","name":"bar","rate":0.5,"burst":3}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Keys = keys
+	server.RateLimiter = ratelimit.New(0.5, 2, time.Minute)
+	httpSrv := httptest.NewServer(server.Handler())
+	defer apiServer.Close()
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		key    string
+		status int
+	}{
+		// Unknown keys are limited per address
+		{"k3", 401},
+		{"k4", 401},
+		{"k5", 429},
+		// Keys without rate share the per-address limit
+		{"k1", 429},
+		// Keys with rate have their own limit
+		{"k2", 200},
+		{"k2", 200},
+		{"k2", 200},
+		{"k2", 429},
+	}
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", httpSrv.URL+"/api/v2/departures/60890", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", tt.key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("#%d: want status %d for key %q, got %d", i, tt.status, tt.key, res.StatusCode)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var correlationID string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		correlationID = r.Header.Get("X-Correlation-Id")
+		fmt.Fprint(w, enturResponse)
+	}))
+	defer apiServer.Close()
+	var buf bytes.Buffer
+	server := New(&entur.Client{URL: apiServer.URL}, 168*time.Hour, 1*time.Minute, false)
+	server.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		url       string
+		requestID string
+		level     string
+		status    float64
+		stopID    float64
+		cache     string
+		err       string
+	}{
+		{"/api/v2/departures/60890", "r1", "INFO", 200, 60890, "MISS", ""},
+		{"/api/v2/departures/60890", "", "INFO", 200, 60890, "HIT", ""},
+		{"/api/v2/departures/foo", "r3", "WARN", 400, 0, "", `strconv.Atoi: parsing "foo": invalid syntax`},
+	}
+	for i, tt := range tests {
+		buf.Reset()
+		req, err := http.NewRequest("GET", httpSrv.URL+tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.requestID != "" {
+			req.Header.Set("X-Request-ID", tt.requestID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		requestID := res.Header.Get("X-Request-ID")
+		if tt.requestID != "" && requestID != tt.requestID {
+			t.Errorf("#%d: want request ID %q, got %q", i, tt.requestID, requestID)
+		} else if requestID == "" {
+			t.Errorf("#%d: want generated request ID", i)
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if got := entry["requestId"]; got != requestID {
+			t.Errorf("#%d: want logged requestId = %q, got %v", i, requestID, got)
+		}
+		if got := entry["level"]; got != tt.level {
+			t.Errorf("#%d: want logged level = %q, got %v", i, tt.level, got)
+		}
+		if got := entry["status"]; got != tt.status {
+			t.Errorf("#%d: want logged status = %v, got %v", i, tt.status, got)
+		}
+		if got, _ := entry["stopId"].(float64); got != tt.stopID {
+			t.Errorf("#%d: want logged stopId = %v, got %v", i, tt.stopID, got)
+		}
+		if got, _ := entry["cache"].(string); got != tt.cache {
+			t.Errorf("#%d: want logged cache = %q, got %q", i, tt.cache, got)
+		}
+		if got, _ := entry["error"].(string); got != tt.err {
+			t.Errorf("#%d: want logged error = %q, got %q", i, tt.err, got)
+		}
+		_, hasUpstream := entry["upstreamLatency"]
+		if want := tt.cache == "MISS"; hasUpstream != want {
+			t.Errorf("#%d: want upstreamLatency logged = %t, got %t", i, want, hasUpstream)
+		}
+	}
+	if correlationID != "r1" {
+		t.Errorf("want X-Correlation-Id = %q sent to Entur, got %q", "r1", correlationID)
+	}
+}
+
+func TestAccessLogSource(t *testing.T) {
+	fake := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{41613: {{Line: "3", Destination: "Hallset"}}},
+	}
+	var buf bytes.Buffer
+	composite := source.NewComposite(&source.Fake{Err: errors.New("entur unavailable")}, fake)
+	composite.Logger = slog.New(slog.NewJSONHandler(ioutil.Discard, nil))
+	server := New(composite, 168*time.Hour, 1*time.Minute, false)
+	server.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+
+	if _, _, status, err := httpGet(httpSrv.URL + "/api/v2/departures/41613"); err != nil {
+		t.Fatal(err)
+	} else if status != 200 {
+		t.Fatalf("want status 200, got %d", status)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := entry["source"], "*source.Fake"; got != want {
+		t.Errorf("want logged source = %q, got %v", want, got)
+	}
+	if got, want := entry["upstreamError"], "entur unavailable"; got != want {
+		t.Errorf("want logged upstreamError = %q, got %v", want, got)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	var traceparent string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		fmt.Fprint(w, enturResponse)
+	}))
+	defer apiServer.Close()
+	server := New(&entur.Client{URL: apiServer.URL}, 168*time.Hour, 1*time.Minute, false)
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest("GET", httpSrv.URL+"/api/v2/departures/60890", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if want := "00-" + traceID + "-"; !strings.HasPrefix(traceparent, want) {
+		t.Errorf("want traceparent sent to Entur to start with %q, got %q", want, traceparent)
+	}
+	want := []string{"entur.Departures", "cache.Get", "enturDepartures", "DepartureHandlerV2", "GET /api/v2/departures/"}
+	spans := exporter.GetSpans()
+	if len(spans) != len(want) {
+		t.Fatalf("want %d spans, got %d", len(want), len(spans))
+	}
+	names := make(map[string]bool)
+	for _, span := range spans {
+		names[span.Name] = true
+		if span.SpanKind == trace.SpanKindServer {
+			attrs := attribute.NewSet(span.Attributes...)
+			path, _ := attrs.Value("url.path")
+			if want := "/api/v2/departures/60890"; path.AsString() != want {
+				t.Errorf("want url.path = %q for span %s, got %q", want, span.Name, path.AsString())
+			}
+		}
+		if got := span.SpanContext.TraceID().String(); got != traceID {
+			t.Errorf("want trace ID %s for span %s, got %s", traceID, span.Name, got)
+		}
+	}
+	for _, name := range want {
+		if !names[name] {
+			t.Errorf("want span %s", name)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	apiServer, server := testServers()
+	httpSrv := httptest.NewServer(server.Handler())
+	defer apiServer.Close()
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url         string
+		accept      string
+		contentType string
+		response    string
+		status      int
+	}{
+		{"/api/v2/departures/60890?direction=inbound&format=xml", "", "application/xml; charset=utf-8", `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<departures><url>` + httpSrv.URL + `/api/v2/departures/60890</url><serverTime>2021-08-11T23:30:00.000</serverTime><departure><line>3</line><scheduledDepartureTime>2021-08-11T23:38:01.000</scheduledDepartureTime><destination>Hallset</destination><isRealtimeData>true</isRealtimeData><isGoingTowardsCentrum>true</isGoingTowardsCentrum><serviceJourneyId>ATB:ServiceJourney:3_210811</serviceJourneyId><secondsUntilDeparture>481</secondsUntilDeparture><minutesUntilDeparture>8</minutesUntilDeparture><displayTime>8 min</displayTime></departure></departures>`, 200},
+		{"/api/v2/departures/60890?format=csv", "", "text/csv; charset=utf-8", "line,registeredDepartureTime,scheduledDepartureTime,destination,isRealtimeData,isGoingTowardsCentrum\n11,,2021-08-11T23:33:09.000,Risvollan via sentrum,true,false\n3,,2021-08-11T23:38:01.000,Hallset,true,true\n", 200},
+		{"/api/v2/departures/60890?format=text", "", "text/plain; charset=utf-8", "LINE  TIME   DESTINATION\n11    23:33  Risvollan via sentrum\n3     23:38  Hallset\n", 200},
+		{"/api/v2/departures/60890?direction=inbound", "text/csv", "text/csv; charset=utf-8", "line,registeredDepartureTime,scheduledDepartureTime,destination,isRealtimeData,isGoingTowardsCentrum\n3,,2021-08-11T23:38:01.000,Hallset,true,true\n", 200},
+		{"/api/v2/departures/60890?direction=inbound", "text/plain;q=0.5, text/csv;q=0.9", "text/csv; charset=utf-8", "line,registeredDepartureTime,scheduledDepartureTime,destination,isRealtimeData,isGoingTowardsCentrum\n3,,2021-08-11T23:38:01.000,Hallset,true,true\n", 200},
+		{"/api/v2/departures/60890?direction=inbound", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "application/json", `{"url":"` + httpSrv.URL + `/api/v2/departures/60890","serverTime":"2021-08-11T23:30:00.000","departures":[{"line":"3","scheduledDepartureTime":"2021-08-11T23:38:01.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true,"serviceJourneyId":"ATB:ServiceJourney:3_210811","secondsUntilDeparture":481,"minutesUntilDeparture":8,"displayTime":"8 min"}]}`, 200},
+		{"/api/v2/departures/60890?direction=inbound&format=json", "text/csv", "application/json", `{"url":"` + httpSrv.URL + `/api/v2/departures/60890","serverTime":"2021-08-11T23:30:00.000","departures":[{"line":"3","scheduledDepartureTime":"2021-08-11T23:38:01.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true,"serviceJourneyId":"ATB:ServiceJourney:3_210811","secondsUntilDeparture":481,"minutesUntilDeparture":8,"displayTime":"8 min"}]}`, 200},
+		{"/api/v2/departures/foo?format=text", "", "text/plain; charset=utf-8", "STATUS  MESSAGE\n400     Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs.\n", 400},
+		{"/api/v2/departures/60890?format=yaml", "", "application/json", `{"status":400,"message":"Invalid format: yaml"}`, 400},
+		{"/?format=csv", "", "application/json", `{"status":406,"message":"Format csv is not supported by this resource"}`, 406},
+		{"/", "text/csv", "application/json", urlsResponse(httpSrv.URL), 200},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", httpSrv.URL+tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := res.Header.Get("Content-Type"); got != tt.contentType {
+			t.Errorf("want content-type %s for %s (Accept: %s), got %s", tt.contentType, tt.url, tt.accept, got)
+		}
+		if got := res.StatusCode; got != tt.status {
+			t.Errorf("want status %d for %s (Accept: %s), got %d", tt.status, tt.url, tt.accept, got)
+		}
+		if got := string(data); got != tt.response {
+			t.Errorf("want response %q for %s (Accept: %s), got %q", tt.response, tt.url, tt.accept, got)
+		}
+	}
+}
+
+func TestStopMonitoring(t *testing.T) {
+	apiServer, server := testServers()
+	httpSrv := httptest.NewServer(server.Handler())
+	defer apiServer.Close()
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url      string
+		status   int
+		contains []string
+		excludes []string
+	}{
+		{"/siri/stop-monitoring", 400, []string{`<error><status>400</status><message>Invalid MonitoringRef. Use https://stoppested.entur.org/ to find stop IDs.</message></error>`}, nil},
+		{"/siri/stop-monitoring?MonitoringRef=NSR:StopPlace:60890&MaximumStopVisits=-1", 400, []string{`<message>Invalid MaximumStopVisits</message>`}, nil},
+		{"/siri/stop-monitoring?MonitoringRef=NSR:StopPlace:60890&format=json", 200, []string{
+			`<Siri xmlns="http://www.siri.org.uk/siri" version="2.0">`,
+			`<MonitoringRef>NSR:StopPlace:60890</MonitoringRef>`,
+			`<PublishedLineName>11</PublishedLineName>`,
+			`<PublishedLineName>3</PublishedLineName><OperatorRef>ATB:Operator:171</OperatorRef><DestinationName>Hallset</DestinationName>`,
+			`<ExpectedDepartureTime>2021-08-11T23:38:01+02:00</ExpectedDepartureTime>`,
+		}, nil},
+		{"/siri/stop-monitoring?MonitoringRef=60890&LineRef=3", 200, []string{`<PublishedLineName>3</PublishedLineName>`}, []string{`<PublishedLineName>11</PublishedLineName>`}},
+		{"/siri/stop-monitoring?MonitoringRef=60890&MaximumStopVisits=1", 200, []string{`<PublishedLineName>11</PublishedLineName>`}, []string{`<PublishedLineName>3</PublishedLineName>`}},
+	}
+	for _, tt := range tests {
+		data, contentType, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "application/xml; charset=utf-8"; contentType != want {
+			t.Errorf("want content-type %s for %s, got %s", want, tt.url, contentType)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(data, s) {
+				t.Errorf("want response for %s to contain %s, got %s", tt.url, s, data)
+			}
+		}
+		for _, s := range tt.excludes {
+			if strings.Contains(data, s) {
+				t.Errorf("want response for %s to not contain %s, got %s", tt.url, s, data)
+			}
+		}
+	}
+}
+
+func TestTripUpdates(t *testing.T) {
+	apiServer, server := testServers()
+	httpSrv := httptest.NewServer(server.Handler())
+	defer apiServer.Close()
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	data, contentType, status, err := httpGet(httpSrv.URL + "/gtfs-rt/trip-updates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"status":404,"message":"No stops are configured for the GTFS-Realtime feed"}`; status != 404 || data != want {
+		t.Errorf("want status 404 and response %s, got %d and %s", want, status, data)
+	}
+
+	server.FeedStops = []int{60890}
+	data, contentType, status, err = httpGet(httpSrv.URL + "/gtfs-rt/trip-updates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 200 {
+		t.Errorf("want status 200, got %d", status)
+	}
+	if want := "application/x-protobuf"; contentType != want {
+		t.Errorf("want content-type %s, got %s", want, contentType)
+	}
+	var feed gtfs.FeedMessage
+	if err := proto.Unmarshal([]byte(data), &feed); err != nil {
+		t.Fatal(err)
+	}
+	var tripIDs []string
+	for _, e := range feed.Entity {
+		tripIDs = append(tripIDs, e.GetTripUpdate().GetTrip().GetTripId())
+	}
+	want := []string{"ATB:ServiceJourney:11_210811", "ATB:ServiceJourney:3_210811"}
+	if fmt.Sprint(tripIDs) != fmt.Sprint(want) {
+		t.Errorf("want trips %q, got %q", want, tripIDs)
+	}
+}
+
+func TestTrips(t *testing.T) {
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, time.UTC) }
+	planner := &source.Fake{
+		StopTrips: map[[2]int][]entur.Trip{
+			{41613, 42098}: {
+				{
+					StartTime:    at(18, 14),
+					EndTime:      at(18, 31),
+					Duration:     17 * time.Minute,
+					WalkDistance: 260.5,
+					Legs: []entur.Leg{
+						{
+							Mode:              "foot",
+							From:              entur.Place{Name: "Prinsens gate", StopPlace: "NSR:StopPlace:41613"},
+							To:                entur.Place{Name: "Kongens gate", StopPlace: "NSR:StopPlace:41620"},
+							ExpectedStartTime: at(18, 14),
+							ExpectedEndTime:   at(18, 18),
+							Distance:          260.5,
+						},
+						{
+							Mode:              "bus",
+							Line:              "21",
+							Destination:       "Pirbadet via sentrum",
+							From:              entur.Place{Name: "Kongens gate", StopPlace: "NSR:StopPlace:41620"},
+							To:                entur.Place{Name: "Ilsvika", StopPlace: "NSR:StopPlace:42098"},
+							ExpectedStartTime: at(18, 19),
+							ExpectedEndTime:   at(18, 31),
+							Distance:          3120.2,
+							IsRealtime:        true,
+						},
+					},
+				},
+			},
+		},
+	}
+	server := New(&source.Fake{}, 168*time.Hour, 1*time.Minute, false)
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	data, _, status, err := httpGet(httpSrv.URL + "/api/v2/trips?from=41613&to=42098")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"status":404,"message":"Journey planning is not enabled"}`; status != 404 || data != want {
+		t.Errorf("want status 404 and response %s, got %d and %s", want, status, data)
+	}
+
+	server.Planner = planner
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/api/v2/trips?from=41613&to=42098&time=2022-05-20T18:00:00Z", fmt.Sprintf(`{"url":"%s/api/v2/trips?from=41613\u0026to=42098","trips":[{"scheduledDepartureTime":"2022-05-20T18:14:00.000","scheduledArrivalTime":"2022-05-20T18:31:00.000","duration":1020,"walkDistance":260.5,"legs":[{"mode":"foot","from":{"stopId":41613,"name":"Prinsens gate"},"to":{"stopId":41620,"name":"Kongens gate"},"scheduledDepartureTime":"2022-05-20T18:14:00.000","scheduledArrivalTime":"2022-05-20T18:18:00.000","distance":260.5,"isRealtimeData":false},{"mode":"bus","line":"21","destination":"Pirbadet via sentrum","from":{"stopId":41620,"name":"Kongens gate"},"to":{"stopId":42098,"name":"Ilsvika"},"scheduledDepartureTime":"2022-05-20T18:19:00.000","scheduledArrivalTime":"2022-05-20T18:31:00.000","distance":3120.2,"isRealtimeData":true}]}]}`, httpSrv.URL), 200},
+		{"/api/v2/trips?from=41613&to=42098&format=text", "TRIP  LINE  FROM           DEPARTURE  TO            ARRIVAL\n1     foot  Prinsens gate  18:14      Kongens gate  18:18\n1     21    Kongens gate   18:19      Ilsvika       18:31\n", 200},
+		{"/api/v2/trips?from=42098&to=41613&arriveBy=true", fmt.Sprintf(`{"url":"%s/api/v2/trips?from=42098\u0026to=41613","trips":[]}`, httpSrv.URL), 200},
+		{"/api/v2/trips?to=42098", `{"status":400,"message":"Invalid from stop ID. Use https://stoppested.entur.org/ to find stop IDs."}`, 400},
+		{"/api/v2/trips?from=41613", `{"status":400,"message":"Invalid to stop ID. Use https://stoppested.entur.org/ to find stop IDs."}`, 400},
+		{"/api/v2/trips?from=41613&to=42098&time=18:00", `{"status":400,"message":"Invalid time. Use RFC 3339 format, e.g. 2022-05-20T18:00:00+02:00"}`, 400},
+		{"/api/v2/trips?from=41613&to=42098&arriveBy=maybe", `{"status":400,"message":"Invalid arriveBy"}`, 400},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+}
+
+func TestJourney(t *testing.T) {
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, time.UTC) }
+	planner := &source.Fake{
+		Journeys: map[string]entur.ServiceJourney{
+			"ATB:ServiceJourney:21_1113": {
+				ID:   "ATB:ServiceJourney:21_1113",
+				Line: "21",
+				Calls: []entur.Call{
+					{
+						StopPlace:             "NSR:StopPlace:41613",
+						Name:                  "Prinsens gate",
+						Destination:           "Pirbadet via sentrum",
+						AimedArrivalTime:      at(18, 18),
+						ExpectedArrivalTime:   at(18, 19),
+						AimedDepartureTime:    at(18, 18),
+						ExpectedDepartureTime: at(18, 20),
+						IsRealtime:            true,
+					},
+					{
+						StopPlace:             "NSR:StopPlace:41730",
+						Name:                  "Pirbadet",
+						Destination:           "Pirbadet",
+						AimedArrivalTime:      at(18, 25),
+						ExpectedArrivalTime:   at(18, 25),
+						AimedDepartureTime:    at(18, 25),
+						ExpectedDepartureTime: at(18, 25),
+						IsCancelled:           true,
+					},
+				},
+			},
+		},
+	}
+	server := New(&source.Fake{}, 168*time.Hour, 1*time.Minute, false)
+	server.Planner = planner
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/api/v2/journeys/ATB:ServiceJourney:21_1113", fmt.Sprintf(`{"url":"%s/api/v2/journeys/ATB:ServiceJourney:21_1113","id":"ATB:ServiceJourney:21_1113","line":"21","calls":[{"stopId":41613,"name":"Prinsens gate","destination":"Pirbadet via sentrum","aimedArrivalTime":"2022-05-20T18:18:00.000","expectedArrivalTime":"2022-05-20T18:19:00.000","aimedDepartureTime":"2022-05-20T18:18:00.000","expectedDepartureTime":"2022-05-20T18:20:00.000","isRealtimeData":true,"isCancelled":false},{"stopId":41730,"name":"Pirbadet","destination":"Pirbadet","aimedArrivalTime":"2022-05-20T18:25:00.000","expectedArrivalTime":"2022-05-20T18:25:00.000","aimedDepartureTime":"2022-05-20T18:25:00.000","expectedDepartureTime":"2022-05-20T18:25:00.000","isRealtimeData":false,"isCancelled":true}]}`, httpSrv.URL), 200},
+		{"/api/v2/journeys/ATB:ServiceJourney:21_1113?format=text", "STOP           TIME\nPrinsens gate  18:20\nPirbadet       cancelled\n", 200},
+		{"/api/v2/journeys/ATB:ServiceJourney:21_9999", `{"status":404,"message":"Service journey not found"}`, 404},
+		{"/api/v2/journeys/", `{"status":400,"message":"Missing service journey ID"}`, 400},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+}
+
+func TestLines(t *testing.T) {
+	lines := &source.Fake{
+		AllLines: []entur.Line{
+			{ID: "ATB:Line:2_3", PublicCode: "3", Name: "Lohove - Hallset", TransportMode: "bus", Colour: "E60000", TextColour: "FFFFFF", Operator: "Tide Buss"},
+			{
+				ID:            "ATB:Line:2_21",
+				PublicCode:    "21",
+				Name:          "Pirbadet - Ilsvika",
+				TransportMode: "bus",
+				Routes: []entur.Route{
+					{Direction: "inbound", Stops: []entur.Place{{Name: "Ilsvika", StopPlace: "NSR:StopPlace:42098"}, {Name: "Pirbadet", StopPlace: "NSR:StopPlace:41730"}}},
+					{Direction: "outbound", Stops: []entur.Place{{Name: "Pirbadet", StopPlace: "NSR:StopPlace:41730"}, {Name: "Ilsvika", StopPlace: "NSR:StopPlace:42098"}}},
+				},
+			},
+		},
+	}
+	server := New(&source.Fake{}, 168*time.Hour, 1*time.Minute, false)
+	server.Lines = lines
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+		cache    string
+	}{
+		{"/api/v2/lines", fmt.Sprintf(`{"url":"%[1]s/api/v2/lines","lines":[{"url":"%[1]s/api/v2/lines/3","id":"ATB:Line:2_3","line":"3","name":"Lohove - Hallset","transportMode":"bus","colour":"E60000","textColour":"FFFFFF","operator":"Tide Buss"},{"url":"%[1]s/api/v2/lines/21","id":"ATB:Line:2_21","line":"21","name":"Pirbadet - Ilsvika","transportMode":"bus"}]}`, httpSrv.URL), 200, "MISS"},
+		{"/api/v2/lines?format=text", "LINE  NAME\n3     Lohove - Hallset\n21    Pirbadet - Ilsvika\n", 200, "HIT"},
+		{"/api/v2/lines/21", fmt.Sprintf(`{"url":"%s/api/v2/lines/21","id":"ATB:Line:2_21","line":"21","name":"Pirbadet - Ilsvika","transportMode":"bus","routes":[{"direction":"inbound","stops":[{"stopId":42098,"name":"Ilsvika"},{"stopId":41730,"name":"Pirbadet"}]},{"direction":"outbound","stops":[{"stopId":41730,"name":"Pirbadet"},{"stopId":42098,"name":"Ilsvika"}]}]}`, httpSrv.URL), 200, "MISS"},
+		{"/api/v2/lines/21?format=csv", "direction,stopId,name\ninbound,42098,Ilsvika\ninbound,41730,Pirbadet\noutbound,41730,Pirbadet\noutbound,42098,Ilsvika\n", 200, "HIT"},
+		{"/api/v2/lines/99", `{"status":404,"message":"Line not found"}`, 404, ""},
+	}
+	for _, tt := range tests {
+		res, err := http.Get(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, res.StatusCode)
+		}
+		if string(data) != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+		if got := res.Header.Get("X-Cache"); got != tt.cache {
+			t.Errorf("want X-Cache %q for %s, got %q", tt.cache, tt.url, got)
+		}
+	}
+}
+
+func TestVehicles(t *testing.T) {
+	updated := time.Date(2022, 5, 20, 18, 19, 5, 0, time.UTC)
+	fake := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			41613: {{Line: "3", ServiceJourneyID: "ATB:ServiceJourney:3_210811"}},
+		},
+		AllVehicles: []entur.Vehicle{
+			{ID: "3052", Line: "3", LineID: "ATB:Line:2_3", ServiceJourneyID: "ATB:ServiceJourney:3_210811", Destination: "Hallset", Latitude: 63.430612, Longitude: 10.394321, Bearing: 271.5, Delay: 94 * time.Second, LastUpdated: updated},
+			{ID: "3053", Line: "3", LineID: "ATB:Line:2_3", ServiceJourneyID: "ATB:ServiceJourney:3_210812", Destination: "Lohove", Latitude: 63.422, Longitude: 10.433, Bearing: 90, LastUpdated: updated},
+			{ID: "3117", Line: "21", LineID: "ATB:Line:2_21", ServiceJourneyID: "ATB:ServiceJourney:21_1113", Destination: "Pirbadet via sentrum", Latitude: 63.434205, Longitude: 10.356812, Bearing: 88, Delay: -30 * time.Second, LastUpdated: updated},
+		},
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	data, _, status, err := httpGet(httpSrv.URL + "/api/v2/vehicles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"status":404,"message":"Vehicle positions are not enabled"}`; status != 404 || data != want {
+		t.Errorf("want status 404 and response %s, got %d and %s", want, status, data)
+	}
+
+	vehicles := &countingVehicles{VehicleSource: fake}
+	server.Vehicles = vehicles
+	vehicle3052 := `{"id":"3052","line":"3","serviceJourneyId":"ATB:ServiceJourney:3_210811","destination":"Hallset","latitude":63.430612,"longitude":10.394321,"bearing":271.5,"delay":94,"lastUpdated":"2022-05-20T18:19:05.000"}`
+	vehicle3053 := `{"id":"3053","line":"3","serviceJourneyId":"ATB:ServiceJourney:3_210812","destination":"Lohove","latitude":63.422,"longitude":10.433,"bearing":90,"delay":0,"lastUpdated":"2022-05-20T18:19:05.000"}`
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/api/v2/vehicles?line=3", fmt.Sprintf(`{"url":"%s/api/v2/vehicles","vehicles":[%s,%s]}`, httpSrv.URL, vehicle3052, vehicle3053), 200},
+		{"/api/v2/vehicles?line=ATB:Line:2_3&stop=41613", fmt.Sprintf(`{"url":"%s/api/v2/vehicles","vehicles":[%s]}`, httpSrv.URL, vehicle3052), 200},
+		{"/api/v2/vehicles?format=text", "LINE  DESTINATION           DELAY\n3     Hallset               94\n3     Lohove                0\n21    Pirbadet via sentrum  -30\n", 200},
+		{"/api/v2/vehicles?stop=foo", `{"status":400,"message":"Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs."}`, 400},
+		{"/api/v2/vehicles?stop=60890", `{"status":500,"message":"Failed to get departures from Entur"}`, 500},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+	// Vehicles are retrieved once and then served from cache
+	if got := vehicles.calls.Load(); got != 1 {
+		t.Errorf("want 1 request for vehicles, got %d", got)
+	}
+}
+
+// countingVehicles is a vehicle source which counts requests for vehicles.
+type countingVehicles struct {
+	source.VehicleSource
+	calls atomic.Int32
+}
+
+func (c *countingVehicles) Vehicles(ctx context.Context) ([]entur.Vehicle, error) {
+	c.calls.Add(1)
+	return c.VehicleSource.Vehicles(ctx)
+}
+
+func TestDeparturesV3(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, cest) }
+	fake := &source.Fake{
+		Stops: map[int]entur.Stop{
+			41613: {ID: "NSR:StopPlace:41613", Name: "Prinsens gate", Latitude: 63.431034, Longitude: 10.392019},
+		},
+		StopDepartures: map[int][]entur.Departure{
+			41613: {
+				{Line: "3", LineID: "ATB:Line:2_3", TransportMode: "bus", Quay: "NSR:Quay:71184", ServiceJourneyID: "ATB:ServiceJourney:3_1", AimedDepartureTime: at(18, 0), ScheduledDepartureTime: at(18, 0), RegisteredDepartureTime: at(18, 1), Destination: "Hallset", IsRealtime: true, Inbound: true},
+				{Line: "3", LineID: "ATB:Line:2_3", TransportMode: "bus", Quay: "NSR:Quay:71181", ServiceJourneyID: "ATB:ServiceJourney:3_2", AimedDepartureTime: at(18, 5), ScheduledDepartureTime: at(18, 5), Destination: "Lohove", IsRealtime: true},
+				{Line: "11", LineID: "ATB:Line:2_11", TransportMode: "bus", Quay: "NSR:Quay:71181", ServiceJourneyID: "ATB:ServiceJourney:11_1", AimedDepartureTime: at(18, 5), ScheduledDepartureTime: at(18, 8), Destination: "Risvollan", IsRealtime: true},
+				{Line: "3", LineID: "ATB:Line:2_3", TransportMode: "bus", Quay: "NSR:Quay:71184", ServiceJourneyID: "ATB:ServiceJourney:3_3", AimedDepartureTime: at(18, 10), ScheduledDepartureTime: at(18, 10), Destination: "Hallset", IsRealtime: true, IsCancelled: true, Inbound: true},
+				{Line: "3", LineID: "ATB:Line:2_3", Quay: "NSR:Quay:71184", ServiceJourneyID: "ATB:ServiceJourney:3_4", AimedDepartureTime: at(18, 20), ScheduledDepartureTime: at(18, 20), Destination: "Hallset", Inbound: true},
+			},
+		},
+		StopArrivals: map[int][]entur.Departure{
+			41613: {{Line: "11", LineID: "ATB:Line:2_11", Quay: "NSR:Quay:71181", ServiceJourneyID: "ATB:ServiceJourney:11_2", AimedArrivalTime: at(18, 2), ExpectedArrivalTime: at(18, 3), AimedDepartureTime: at(18, 2), ScheduledDepartureTime: at(18, 3), Destination: "Stavset", IsRealtime: true}},
+		},
+		StopSituations: map[int][]entur.Situation{
+			41613: {{ID: "ATB:SituationNumber:1", Summary: "Holdeplassen er flyttet", Severity: "normal", ValidFrom: at(6, 0)}},
+		},
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2022, 5, 20, 16, 2, 0, 123, time.UTC) }
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	stop := `"stop":{"id":"NSR:StopPlace:41613","name":"Prinsens gate","latitude":63.431034,"longitude":10.392019}`
+	situations := `"situations":[{"id":"ATB:SituationNumber:1","summary":"Holdeplassen er flyttet","severity":"normal","validFrom":"2022-05-20T06:00:00+02:00"}]`
+	departed := `{"line":{"id":"ATB:Line:2_3","publicCode":"3","transportMode":"bus"},"quay":"NSR:Quay:71184","destination":"Hallset","direction":"inbound","serviceJourneyId":"ATB:ServiceJourney:3_1","aimedDepartureTime":"2022-05-20T18:00:00+02:00","expectedDepartureTime":"2022-05-20T18:00:00+02:00","actualDepartureTime":"2022-05-20T18:01:00+02:00","status":"departed"}`
+	onTime := `{"line":{"id":"ATB:Line:2_3","publicCode":"3","transportMode":"bus"},"quay":"NSR:Quay:71181","destination":"Lohove","direction":"outbound","serviceJourneyId":"ATB:ServiceJourney:3_2","aimedDepartureTime":"2022-05-20T18:05:00+02:00","expectedDepartureTime":"2022-05-20T18:05:00+02:00","status":"onTime"}`
+	delayed := `{"line":{"id":"ATB:Line:2_11","publicCode":"11","transportMode":"bus"},"quay":"NSR:Quay:71181","destination":"Risvollan","direction":"outbound","serviceJourneyId":"ATB:ServiceJourney:11_1","aimedDepartureTime":"2022-05-20T18:05:00+02:00","expectedDepartureTime":"2022-05-20T18:08:00+02:00","status":"delayed"}`
+	cancelled := `{"line":{"id":"ATB:Line:2_3","publicCode":"3","transportMode":"bus"},"quay":"NSR:Quay:71184","destination":"Hallset","direction":"inbound","serviceJourneyId":"ATB:ServiceJourney:3_3","aimedDepartureTime":"2022-05-20T18:10:00+02:00","expectedDepartureTime":"2022-05-20T18:10:00+02:00","status":"cancelled"}`
+	scheduled := `{"line":{"id":"ATB:Line:2_3","publicCode":"3"},"quay":"NSR:Quay:71184","destination":"Hallset","direction":"inbound","serviceJourneyId":"ATB:ServiceJourney:3_4","aimedDepartureTime":"2022-05-20T18:20:00+02:00","expectedDepartureTime":"2022-05-20T18:20:00+02:00","status":"scheduled"}`
+	arrival := `{"line":{"id":"ATB:Line:2_11","publicCode":"11"},"quay":"NSR:Quay:71181","destination":"Stavset","direction":"outbound","serviceJourneyId":"ATB:ServiceJourney:11_2","aimedArrivalTime":"2022-05-20T18:02:00+02:00","expectedArrivalTime":"2022-05-20T18:03:00+02:00","aimedDepartureTime":"2022-05-20T18:02:00+02:00","expectedDepartureTime":"2022-05-20T18:03:00+02:00","status":"delayed"}`
+	response := func(departures ...string) string {
+		return fmt.Sprintf(`{"url":"%s/api/v3/departures/41613","serverTime":"2022-05-20T16:02:00Z",%s,"departures":[%s],%s}`, httpSrv.URL, stop, strings.Join(departures, ","), situations)
+	}
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/api/v3/departures/41613", response(departed, onTime, delayed, cancelled, scheduled), 200},
+		{"/api/v3/departures/41613?direction=inbound", response(departed, cancelled, scheduled), 200},
+		{"/api/v3/departures/41613?direction=outbound", response(onTime, delayed), 200},
+		{"/api/v3/departures/41613?type=arrivals", response(arrival), 200},
+		{"/api/v3/departures/41613?direction=foo", `{"status":400,"message":"Invalid direction: foo"}`, 400},
+		{"/api/v3/departures/41613?type=foo", `{"status":400,"message":"Invalid type: foo"}`, 400},
+		{"/api/v3/departures/foo", `{"status":400,"message":"Invalid stop ID. Use https://stoppested.entur.org/ to find stop IDs."}`, 400},
+		{"/api/v3/departures/1", `{"status":404,"message":"Stop not found"}`, 404},
+		{"/api/v3/departures/41613?format=csv", `{"status":406,"message":"Format csv is not supported by this resource"}`, 406},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+}
+
+func TestCancelledDepartures(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, cest) }
+	fake := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			41613: {
+				{Line: "3", ScheduledDepartureTime: at(18, 5), Destination: "Hallset", IsRealtime: true, IsCancelled: true, Inbound: true},
+				{Line: "3", ScheduledDepartureTime: at(18, 10), Destination: "Hallset", IsRealtime: true, Inbound: true},
+			},
+		},
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2022, 5, 20, 16, 2, 0, 0, time.UTC) }
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url      string
+		response string
+	}{
+		{"/api/v2/departures/41613", `{"url":"` + httpSrv.URL + `/api/v2/departures/41613","serverTime":"2022-05-20T18:02:00.000","departures":[` +
+			`{"line":"3","scheduledDepartureTime":"2022-05-20T18:05:00.000","destination":"Hallset","isRealtimeData":true,"isCancelled":true,"isGoingTowardsCentrum":true,"secondsUntilDeparture":180,"minutesUntilDeparture":3,"displayTime":"innstilt"},` +
+			`{"line":"3","scheduledDepartureTime":"2022-05-20T18:10:00.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true,"secondsUntilDeparture":480,"minutesUntilDeparture":8,"displayTime":"8 min"}]}`},
+		{"/api/v2/departures/41613?format=text", "LINE  TIME      DESTINATION\n3     innstilt  Hallset\n3     18:10     Hallset\n"},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Errorf("want status 200 for %s, got %d", tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+}
+
+func TestBoard(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, cest) }
+	fake := &source.Fake{
+		Stops: map[int]entur.Stop{
+			41613: {ID: "NSR:StopPlace:41613", Name: "Prinsens gate"},
+			42098: {ID: "NSR:StopPlace:42098", Name: "Studentersamfundet"},
+		},
+		StopDepartures: map[int][]entur.Departure{
+			41613: {
+				{Line: "3", LineID: "ATB:Line:2_3", ScheduledDepartureTime: at(18, 5), Destination: "Hallset", IsRealtime: true, Inbound: true},
+				{Line: "11", LineID: "ATB:Line:2_11", ScheduledDepartureTime: at(18, 8), Destination: "Risvollan", IsRealtime: true},
+				{Line: "3", LineID: "ATB:Line:2_3", ScheduledDepartureTime: at(18, 10), Destination: "Hallset", IsRealtime: true, IsCancelled: true, Inbound: true},
+				{Line: "3", LineID: "ATB:Line:2_3", ScheduledDepartureTime: at(18, 20), Destination: "Hallset", Inbound: true},
+			},
+			42098: {},
+		},
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2022, 5, 20, 16, 2, 0, 0, time.UTC) }
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	hallset := `<tr class=""><td class="line">3</td><td class="destination">Hallset</td><td class="time">3 min</td></tr>`
+	risvollan := `<tr class=""><td class="line">11</td><td class="destination">Risvollan</td><td class="time">6 min</td></tr>`
+	cancelled := `<tr class="cancelled"><td class="line">3</td><td class="destination">Hallset</td><td class="time">Innstilt</td></tr>`
+	scheduled := `<tr class="scheduled"><td class="line">3</td><td class="destination">Hallset</td><td class="time">ca. 18:20</td></tr>`
+	var tests = []struct {
+		url      string
+		status   int
+		contains []string
+		excludes []string
+	}{
+		{"/board/41613", 200, []string{`<meta http-equiv="refresh" content="30">`, "<title>Prinsens gate</title>", `<div class="clock">18:02</div>`, hallset, risvollan, cancelled, scheduled}, nil},
+		{"/board/41613?direction=outbound&refresh=60", 200, []string{`content="60"`, risvollan}, []string{hallset, cancelled, scheduled}},
+		{"/board/41613?line=3&limit=2", 200, []string{hallset, cancelled}, []string{risvollan, scheduled}},
+		{"/board/41613,42098?line=11,4", 200, []string{"<title>Prinsens gate, Studentersamfundet</title>", risvollan, "<p>Ingen avganger</p>"}, []string{hallset}},
+		{"/board/41613?direction=foo", 400, []string{`<p class="error">Invalid direction: foo</p>`}, []string{"http-equiv"}},
+		{"/board/41613?refresh=1", 400, []string{`<p class="error">Invalid refresh: 1</p>`}, nil},
+		{"/board/41613?limit=0", 400, []string{`<p class="error">Invalid limit: 0</p>`}, nil},
+		{"/board/foo", 400, []string{"Invalid stop IDs."}, nil},
+		{"/board/41613,1", 404, []string{`<p class="error">Stop not found: 1</p>`}, nil},
+	}
+	for _, tt := range tests {
+		data, contentType, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if want := "text/html; charset=utf-8"; contentType != want {
+			t.Errorf("want content type %s for %s, got %s", want, tt.url, contentType)
+		}
+		for _, s := range tt.contains {
+			if !strings.Contains(data, s) {
+				t.Errorf("want response for %s to contain %s, got %s", tt.url, s, data)
+			}
+		}
+		for _, s := range tt.excludes {
+			if strings.Contains(data, s) {
+				t.Errorf("want response for %s to not contain %s, got %s", tt.url, s, data)
+			}
+		}
+	}
+}
+
+func TestNamedBoards(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	at := func(hour, min int) time.Time { return time.Date(2022, 5, 20, hour, min, 0, 0, cest) }
+	fake := &source.Fake{
+		Stops: map[int]entur.Stop{
+			41613: {ID: "NSR:StopPlace:41613", Name: "Prinsens gate"},
+			42098: {ID: "NSR:StopPlace:42098", Name: "Studentersamfundet"},
+		},
+		StopDepartures: map[int][]entur.Departure{
+			41613: {
+				{Line: "3", ScheduledDepartureTime: at(18, 5), Destination: "Hallset", IsRealtime: true, Inbound: true},
+				{Line: "3", ScheduledDepartureTime: at(18, 6), Destination: "Lohove", IsRealtime: true},
+			},
+			42098: {
+				{Line: "21", ScheduledDepartureTime: at(18, 7), Destination: "Pirbadet", IsRealtime: true},
+				{Line: "22", ScheduledDepartureTime: at(18, 8), Destination: "Tyholt", IsRealtime: true},
+			},
+		},
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2022, 5, 20, 16, 2, 0, 0, time.UTC) }
+	keys, err := auth.Parse([]byte(`{"keys":[{"key":"k1","name":"foo","admin":true},{"key":"k2","name":"bar"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Keys = keys
+	server.Anonymous = true
+	file := filepath.Join(t.TempDir(), "boards.json")
+	server.Boards, err = board.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	office := `{"url":"` + httpSrv.URL + `/api/v2/boards/office","name":"office","stops":[{"id":41613,"direction":"inbound"},{"id":42098,"lines":["21","3"]}]}`
+	departures := `{"url":"` + httpSrv.URL + `/api/v2/boards/office","name":"office","serverTime":"2022-05-20T18:02:00.000","stops":[` +
+		`{"url":"` + httpSrv.URL + `/api/v2/departures/41613","id":41613,"direction":"inbound","departures":[{"line":"3","scheduledDepartureTime":"2022-05-20T18:05:00.000","destination":"Hallset","isRealtimeData":true,"isGoingTowardsCentrum":true,"secondsUntilDeparture":180,"minutesUntilDeparture":3,"displayTime":"3 min"}]},` +
+		`{"url":"` + httpSrv.URL + `/api/v2/departures/42098","id":42098,"lines":["21","3"],"departures":[{"line":"21","scheduledDepartureTime":"2022-05-20T18:07:00.000","destination":"Pirbadet","isRealtimeData":true,"isGoingTowardsCentrum":false,"secondsUntilDeparture":300,"minutesUntilDeparture":5,"displayTime":"5 min"}]}]}`
+	var tests = []struct {
+		method   string
+		url      string
+		key      string
+		body     string
+		response string
+		status   int
+	}{
+		{"GET", "/api/v2/boards", "", "", `{"url":"` + httpSrv.URL + `/api/v2/boards","boards":[]}`, 200},
+		{"PUT", "/api/v2/boards/office", "", `{"stops":[{"id":41613}]}`, `{"status":401,"message":"API key required"}`, 401},
+		{"PUT", "/api/v2/boards/office", "k2", `{"stops":[{"id":41613}]}`, `{"status":403,"message":"Admin API key required"}`, 403},
+		{"PUT", "/api/v2/boards/office", "k1", `{"stops":[]}`, `{"status":400,"message":"Invalid board: office: no stops"}`, 400},
+		{"PUT", "/api/v2/boards/office", "k1", `{"name":"home","stops":[{"id":41613}]}`, `{"status":400,"message":"Invalid board: name \"home\" does not match \"office\""}`, 400},
+		{"PUT", "/api/v2/boards/Office", "k1", `{"stops":[{"id":41613}]}`, `{"status":400,"message":"Invalid board: invalid name: \"Office\""}`, 400},
+		{"PUT", "/api/v2/boards/office", "k1", `{"stops":[{"id":41613,"direction":"inbound"},{"id":42098,"lines":["21","3"]}]}`, office, 200},
+		// Requests with side effects respond with JSON regardless of format
+		{"PUT", "/api/v2/boards/home?format=csv", "k1", `{"stops":[{"id":42098}]}`, `{"url":"` + httpSrv.URL + `/api/v2/boards/home","name":"home","stops":[{"id":42098}]}`, 200},
+		{"DELETE", "/api/v2/boards/home?format=text", "k1", "", `{"url":"` + httpSrv.URL + `/api/v2/boards/home","name":"home","stops":[{"id":42098}]}`, 200},
+		{"DELETE", "/api/v2/boards/home", "k1", "", `{"status":404,"message":"Board not found"}`, 404},
+		{"POST", "/api/v2/boards/office", "k1", "", `{"status":405,"message":"Method not allowed: POST"}`, 405},
+		{"GET", "/api/v2/boards", "", "", `{"url":"` + httpSrv.URL + `/api/v2/boards","boards":[` + office + `]}`, 200},
+		{"GET", "/api/v2/boards/office", "", "", departures, 200},
+		{"GET", "/api/v2/boards/home", "", "", `{"status":404,"message":"Board not found"}`, 404},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, httpSrv.URL+tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("want status %d for %s %s, got %d", tt.status, tt.method, tt.url, res.StatusCode)
+		}
+		if got := string(data); got != tt.response {
+			t.Errorf("want response %s for %s %s, got %s", tt.response, tt.method, tt.url, got)
+		}
+	}
+
+	// Boards are persisted
+	boards, err := board.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := boards.List(); len(names) != 1 || names[0].Name != "office" {
+		t.Errorf("want office to be persisted, got %+v", names)
+	}
+
+	// HTML board can reference a named board
+	data, _, status, err := httpGet(httpSrv.URL + "/board/office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 200 || !strings.Contains(data, "<title>Prinsens gate, Studentersamfundet</title>") || strings.Contains(data, "Lohove") || strings.Contains(data, "Tyholt") {
+		t.Errorf("want board for office, got %d %s", status, data)
+	}
+	if _, _, status, _ := httpGet(httpSrv.URL + "/board/cabin"); status != 404 {
+		t.Errorf("want status 404 for unknown board, got %d", status)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	server := New(&source.Fake{}, 168*time.Hour, 1*time.Minute, true)
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	req, err := http.NewRequest(http.MethodOptions, httpSrv.URL+"/api/v2/boards/office", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("want status %d, got %d", http.StatusNoContent, res.StatusCode)
+	}
+	var headers = []struct {
+		name  string
+		value string
+	}{
+		{"Access-Control-Allow-Origin", "*"},
+		{"Access-Control-Allow-Methods", "GET, PUT, DELETE"},
+		{"Access-Control-Allow-Headers", "X-API-Key, Content-Type"},
+	}
+	for _, h := range headers {
+		if got := res.Header.Get(h.name); got != h.value {
+			t.Errorf("want %s = %q, got %q", h.name, h.value, got)
+		}
+	}
+}
+
+func TestArrivals(t *testing.T) {
+	arrival := time.Date(2022, 5, 20, 18, 25, 0, 0, time.UTC)
+	fake := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			41730: {},
+			41620: {{Line: "21", ExpectedArrivalTime: arrival, ScheduledDepartureTime: arrival.Add(time.Minute), Destination: "Pirbadet", IsRealtime: true}},
+		},
+		StopArrivals: map[int][]entur.Departure{
+			41730: {{Line: "21", ExpectedArrivalTime: arrival, ScheduledDepartureTime: arrival, Destination: "Pirbadet", IsRealtime: true}},
+		},
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2022, 5, 20, 18, 20, 0, 0, time.UTC) }
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/api/v2/departures/41730", fmt.Sprintf(`{"url":"%s/api/v2/departures/41730","serverTime":"2022-05-20T18:20:00.000","departures":[]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?type=departures", fmt.Sprintf(`{"url":"%s/api/v2/departures/41730","serverTime":"2022-05-20T18:20:00.000","departures":[]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?type=arrivals", fmt.Sprintf(`{"url":"%s/api/v2/departures/41730","serverTime":"2022-05-20T18:20:00.000","departures":[{"line":"21","scheduledArrivalTime":"2022-05-20T18:25:00.000","scheduledDepartureTime":"2022-05-20T18:25:00.000","destination":"Pirbadet","isRealtimeData":true,"isGoingTowardsCentrum":false,"secondsUntilDeparture":300,"minutesUntilDeparture":5,"displayTime":"5 min"}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?type=arrivals&format=text", "LINE  TIME   DESTINATION\n21    18:25  Pirbadet\n", 200},
+		{"/api/v2/departures/41730?type=arrivals&format=csv", "line,scheduledArrivalTime,registeredDepartureTime,scheduledDepartureTime,destination,isRealtimeData,isGoingTowardsCentrum\n21,2022-05-20T18:25:00.000,,2022-05-20T18:25:00.000,Pirbadet,true,false\n", 200},
+		// Arrival time is only included when listing arrivals
+		{"/api/v2/departures/41620", fmt.Sprintf(`{"url":"%s/api/v2/departures/41620","serverTime":"2022-05-20T18:20:00.000","departures":[{"line":"21","scheduledDepartureTime":"2022-05-20T18:26:00.000","destination":"Pirbadet","isRealtimeData":true,"isGoingTowardsCentrum":false,"secondsUntilDeparture":360,"minutesUntilDeparture":6,"displayTime":"6 min"}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?type=foo", `{"status":400,"message":"Invalid type: foo"}`, 400},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	scheduled := time.Date(2022, 5, 20, 18, 25, 0, 0, time.FixedZone("CEST", 2*60*60))
+	fake := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			41730: {{Line: "21", ScheduledDepartureTime: scheduled, Destination: "Pirbadet", IsRealtime: true}},
+		},
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2022, 5, 20, 16, 20, 0, 0, time.UTC) }
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/api/v2/departures/41730", fmt.Sprintf(`{"url":"%s/api/v2/departures/41730","serverTime":"2022-05-20T18:20:00.000","departures":[{"line":"21","scheduledDepartureTime":"2022-05-20T18:25:00.000","destination":"Pirbadet","isRealtimeData":true,"isGoingTowardsCentrum":false,"secondsUntilDeparture":300,"minutesUntilDeparture":5,"displayTime":"5 min"}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?timeFormat=local", fmt.Sprintf(`{"url":"%s/api/v2/departures/41730","serverTime":"2022-05-20T18:20:00.000","departures":[{"line":"21","scheduledDepartureTime":"2022-05-20T18:25:00.000","destination":"Pirbadet","isRealtimeData":true,"isGoingTowardsCentrum":false,"secondsUntilDeparture":300,"minutesUntilDeparture":5,"displayTime":"5 min"}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?timeFormat=rfc3339", fmt.Sprintf(`{"url":"%s/api/v2/departures/41730","serverTime":"2022-05-20T18:20:00+02:00","departures":[{"line":"21","scheduledDepartureTime":"2022-05-20T18:25:00+02:00","destination":"Pirbadet","isRealtimeData":true,"isGoingTowardsCentrum":false,"secondsUntilDeparture":300,"minutesUntilDeparture":5,"displayTime":"5 min"}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?timeFormat=unix", fmt.Sprintf(`{"url":"%s/api/v2/departures/41730","serverTime":1653063600,"departures":[{"line":"21","scheduledDepartureTime":1653063900,"destination":"Pirbadet","isRealtimeData":true,"isGoingTowardsCentrum":false,"secondsUntilDeparture":300,"minutesUntilDeparture":5,"displayTime":"5 min"}]}`, httpSrv.URL), 200},
+		{"/api/v2/departures/41730?timeFormat=rfc3339&format=text", "LINE  TIME   DESTINATION\n21    18:25  Pirbadet\n", 200},
+		{"/api/v2/departures/41730?timeFormat=foo", `{"status":400,"message":"Invalid timeFormat: foo"}`, 400},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+}
+
+func TestDirections(t *testing.T) {
+	scheduled := time.Date(2022, 5, 20, 18, 25, 0, 0, time.UTC)
+	fake := &source.Fake{
+		Stops: map[int]entur.Stop{42098: {ID: "NSR:StopPlace:42098", Name: "Ilsvika"}},
+		StopDepartures: map[int][]entur.Departure{
+			42098: {
+				{Line: "21", ServiceJourneyID: "ATB:ServiceJourney:21_1", Quay: "NSR:Quay:73154", ScheduledDepartureTime: scheduled, Destination: "Pirbadet", Inbound: false},
+				{Line: "21", ServiceJourneyID: "ATB:ServiceJourney:21_2", Quay: "NSR:Quay:73155", ScheduledDepartureTime: scheduled, Destination: "Ilsvika", Inbound: true},
+				{Line: "3", ServiceJourneyID: "ATB:ServiceJourney:3_1", Quay: "NSR:Quay:73155", ScheduledDepartureTime: scheduled, Destination: "Hallset", Inbound: false},
+			},
+		},
+		Journeys: map[string]entur.ServiceJourney{
+			"ATB:ServiceJourney:21_1": {ID: "ATB:ServiceJourney:21_1", Calls: []entur.Call{
+				{StopPlace: "NSR:StopPlace:42098", Quay: "NSR:Quay:73154"},
+				{StopPlace: "NSR:StopPlace:41613", Quay: "NSR:Quay:71184"},
+			}},
+			"ATB:ServiceJourney:21_2": {ID: "ATB:ServiceJourney:21_2", Calls: []entur.Call{
+				{StopPlace: "NSR:StopPlace:41613", Quay: "NSR:Quay:71181"},
+				{StopPlace: "NSR:StopPlace:42098", Quay: "NSR:Quay:73155"},
+			}},
+		},
+	}
+	rules, err := direction.Parse([]byte(`{"rules":[{"line":"3","destination":"Hallset","direction":"inbound"}],"centreStops":[41613]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(fake, 168*time.Hour, 1*time.Minute, false)
+	server.Planner = fake
+	server.Directions = rules
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		url          string
+		destinations []string
+	}{
+		{"/api/v2/departures/42098", []string{"Pirbadet", "Ilsvika", "Hallset"}},
+		{"/api/v2/departures/42098?direction=inbound", []string{"Pirbadet", "Hallset"}},
+		{"/api/v2/departures/42098?direction=outbound", []string{"Ilsvika"}},
+		{"/api/v3/departures/42098?direction=inbound", []string{"Pirbadet", "Hallset"}},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Fatalf("want status 200 for %s, got %d", tt.url, status)
+		}
+		var response struct {
+			Departures []struct {
+				Destination string `json:"destination"`
+			} `json:"departures"`
+		}
+		if err := json.Unmarshal([]byte(data), &response); err != nil {
+			t.Fatal(err)
+		}
+		var destinations []string
+		for _, d := range response.Departures {
+			destinations = append(destinations, d.Destination)
+		}
+		if strings.Join(destinations, ",") != strings.Join(tt.destinations, ",") {
+			t.Errorf("want destinations %q for %s, got %q", tt.destinations, tt.url, destinations)
+		}
+	}
+}
+
+func TestSourceFallback(t *testing.T) {
+	unavailable := &source.Fake{Err: fmt.Errorf("entur: service unavailable")}
+	scheduled := time.Date(2022, 5, 21, 0, 10, 0, 0, time.UTC)
+	fallback := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			41613: {
+				{Line: "3", ScheduledDepartureTime: scheduled, Destination: "Hallset", Inbound: true},
+				{Line: "3", ScheduledDepartureTime: scheduled, Destination: "Lohove", Inbound: false},
+			},
+		},
+	}
+	log.SetOutput(ioutil.Discard)
+	server := New(source.NewComposite(unavailable, fallback), 168*time.Hour, 1*time.Minute, false)
+	server.now = func() time.Time { return time.Date(2022, 5, 21, 0, 0, 0, 0, time.UTC) }
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		url      string
+		response string
+		status   int
+	}{
+		{"/api/v2/departures/41613?direction=inbound", fmt.Sprintf(`{"url":"%s/api/v2/departures/41613","serverTime":"2022-05-21T00:00:00.000","departures":[{"line":"3","scheduledDepartureTime":"2022-05-21T00:10:00.000","destination":"Hallset","isRealtimeData":false,"isGoingTowardsCentrum":true,"secondsUntilDeparture":600,"minutesUntilDeparture":10,"displayTime":"00:10"}]}`, httpSrv.URL), 200},
+		// Stop is not known by any source
+		{"/api/v2/departures/60890", `{"status":500,"message":"Failed to get departures from Entur"}`, 500},
+	}
+	for _, tt := range tests {
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if data != tt.response {
+			t.Errorf("want response %s for %s, got %s", tt.response, tt.url, data)
+		}
+	}
+}
+
+// blockingPlanner is a journey planner whose service journeys never arrive.
+type blockingPlanner struct{ calls atomic.Int32 }
+
+func (p *blockingPlanner) Trips(ctx context.Context, fromID, toID int, t time.Time, arriveBy bool) ([]entur.Trip, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (p *blockingPlanner) ServiceJourney(ctx context.Context, id string) (entur.ServiceJourney, error) {
+	p.calls.Add(1)
+	<-ctx.Done()
+	return entur.ServiceJourney{}, ctx.Err()
+}
+
+func TestClassifyFallback(t *testing.T) {
+	scheduled := time.Date(2022, 5, 21, 0, 10, 0, 0, time.UTC)
+	realtime := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			42098: {
+				{Line: "21", ServiceJourneyID: "ATB:ServiceJourney:21_1", ScheduledDepartureTime: scheduled, Destination: "Pirbadet", IsRealtime: true, Inbound: true},
+				{Line: "21", ServiceJourneyID: "ATB:ServiceJourney:21_2", ScheduledDepartureTime: scheduled, Destination: "Ilsvika", IsRealtime: true, Inbound: false},
+			},
+		},
+	}
+	fallback := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			41613: {
+				{Line: "3", ServiceJourneyID: "3_1", ScheduledDepartureTime: scheduled, Destination: "Hallset", Inbound: true, Timetable: true},
+				{Line: "3", ServiceJourneyID: "3_2", ScheduledDepartureTime: scheduled, Destination: "Lohove", Inbound: false, Timetable: true},
+			},
+		},
+	}
+	rules, err := direction.Parse([]byte(`{"centreStops":[41613]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable := &source.Fake{Err: fmt.Errorf("entur: service unavailable")}
+	planner := &blockingPlanner{}
+	log.SetOutput(ioutil.Discard)
+	server := New(source.NewComposite(unavailable, realtime, fallback), 168*time.Hour, 1*time.Minute, false)
+	server.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	server.Planner = planner
+	server.Directions = rules
+	server.journeyTimeout = 50 * time.Millisecond
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+
+	var tests = []struct {
+		url          string
+		destinations []string
+		calls        int32
+	}{
+		// Journeys of timetable departures are not retrieved
+		{"/api/v2/departures/41613?direction=inbound", []string{"Hallset"}, 0},
+		// Journeys of real-time departures are retrieved, but retrieval gives up at the deadline
+		{"/api/v2/departures/42098?direction=inbound", []string{"Pirbadet"}, 2},
+	}
+	for _, tt := range tests {
+		planner.calls.Store(0)
+		data, _, status, err := httpGet(httpSrv.URL + tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Fatalf("want status 200 for %s, got %d", tt.url, status)
+		}
+		var response struct {
+			Departures []struct {
+				Destination string `json:"destination"`
+			} `json:"departures"`
+		}
+		if err := json.Unmarshal([]byte(data), &response); err != nil {
+			t.Fatal(err)
+		}
+		var destinations []string
+		for _, d := range response.Departures {
+			destinations = append(destinations, d.Destination)
+		}
+		if strings.Join(destinations, ",") != strings.Join(tt.destinations, ",") {
+			t.Errorf("want destinations %q for %s, got %q", tt.destinations, tt.url, destinations)
+		}
+		if got := planner.calls.Load(); got != tt.calls {
+			t.Errorf("want %d journey lookups for %s, got %d", tt.calls, tt.url, got)
+		}
+	}
+}
+
+// slowSource is a departure source which waits for delay before returning departures.
+type slowSource struct {
+	source.DepartureSource
+	delay time.Duration
+}
+
+func (s slowSource) Departures(ctx context.Context, count, stopID int) ([]entur.Departure, error) {
+	time.Sleep(s.delay)
+	return s.DepartureSource.Departures(ctx, count, stopID)
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	scheduled := time.Date(2022, 5, 21, 0, 10, 0, 0, time.UTC)
+	fake := &source.Fake{
+		StopDepartures: map[int][]entur.Departure{
+			41613: {{Line: "3", ServiceJourneyID: "ATB:ServiceJourney:3_1", ScheduledDepartureTime: scheduled, Destination: "Hallset", IsRealtime: true}},
+			42098: {{Line: "21", ServiceJourneyID: "ATB:ServiceJourney:21_1", ScheduledDepartureTime: scheduled, Destination: "Pirbadet", IsRealtime: true}},
+		},
+	}
+	rules, err := direction.Parse([]byte(`{"centreStops":[41613]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay := 20 * time.Millisecond
+	server := New(slowSource{fake, delay}, 168*time.Hour, 1*time.Minute, false)
+	server.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	server.Planner = &blockingPlanner{}
+	server.Directions = rules
+	server.journeyTimeout = 10 * delay
+
+	info := &requestInfo{}
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, info)
+	for _, stopID := range []int{41613, 42098} {
+		if _, _, err := server.departures(ctx, stopID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Latency of each source request is accumulated, and time spent classifying departures is not included
+	if min, max := 2*delay, server.journeyTimeout; info.upstream < min || info.upstream >= max {
+		t.Errorf("want upstream latency in [%s, %s), got %s", min, max, info.upstream)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := []*net.IPNet{proxies}
+	var tests = []struct {
+		remoteAddr   string
+		forwardedFor []string
+		out          string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"}, // Untrusted proxy
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.1", "198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", []string{"garbage"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remoteAddr, Header: http.Header{}}
+		for _, v := range tt.forwardedFor {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r, trusted); got != tt.out {
+			t.Errorf("clientIP(%q, %q) = %s, want %s", tt.remoteAddr, tt.forwardedFor, got, tt.out)
+		}
+	}
+}
+
 const enturResponse = `{
   "data": {
     "stopPlace": {
@@ -115,6 +1557,7 @@ const enturResponse = `{
             "frontText": "Risvollan via sentrum"
           },
           "serviceJourney": {
+            "id": "ATB:ServiceJourney:11_210811",
             "operator": {
               "id": "ATB:Operator:171"
             },
@@ -134,6 +1577,7 @@ const enturResponse = `{
             "frontText": "Hallset"
           },
           "serviceJourney": {
+            "id": "ATB:ServiceJourney:3_210811",
             "operator": {
               "id": "ATB:Operator:171"
             },
@@ -0,0 +1,108 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mpolden/atb/entur"
+	"github.com/mpolden/atb/source"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo collects details about a request which are only known by the handler serving it.
+type requestInfo struct {
+	stopID   int
+	upstream time.Duration
+	source   source.Report
+	err      error
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func infoFromContext(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{} // Discarded
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		info := &requestInfo{}
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		ctx = entur.WithRequestID(ctx, requestID)
+		ctx = source.WithReport(ctx, &info.source)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		attrs := []slog.Attr{
+			slog.String("requestId", requestID),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			attrs = append(attrs, slog.String("traceId", sc.TraceID().String()))
+		}
+		if info.stopID != 0 {
+			attrs = append(attrs, slog.Int("stopId", info.stopID))
+		}
+		if cache := w.Header().Get("X-Cache"); cache != "" {
+			attrs = append(attrs, slog.String("cache", cache))
+		}
+		if info.upstream > 0 {
+			attrs = append(attrs, slog.Duration("upstreamLatency", info.upstream))
+		}
+		if info.source.Source != "" {
+			attrs = append(attrs, slog.String("source", info.source.Source))
+		}
+		if info.source.Err != nil {
+			attrs = append(attrs, slog.String("upstreamError", info.source.Err.Error()))
+		}
+		level := slog.LevelInfo
+		if info.err != nil {
+			attrs = append(attrs, slog.String("error", info.err.Error()))
+			if rec.status >= 500 {
+				level = slog.LevelError
+			} else {
+				level = slog.LevelWarn
+			}
+		}
+		s.logger().LogAttrs(ctx, level, "request", attrs...)
+	})
+}
@@ -0,0 +1,308 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mpolden/atb/auth"
+	"github.com/mpolden/atb/board"
+	"github.com/mpolden/atb/entur"
+	"github.com/mpolden/atb/ratelimit"
+	"github.com/mpolden/atb/source"
+)
+
+type openAPIDoc map[string]interface{}
+
+func (d openAPIDoc) resolve(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	ref, ok := m["$ref"].(string)
+	if !ok {
+		return m
+	}
+	var node interface{} = map[string]interface{}(d)
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		node = node.(map[string]interface{})[part]
+	}
+	return d.resolve(node)
+}
+
+func (d openAPIDoc) responseSchema(path string, status int, mediaType string) (map[string]interface{}, error) {
+	op, ok := d.resolve(d.resolve(d["paths"])[path])["get"]
+	if !ok {
+		return nil, fmt.Errorf("no GET operation for %s", path)
+	}
+	responses := d.resolve(d.resolve(op)["responses"])
+	response, ok := responses[strconv.Itoa(status)]
+	if !ok {
+		return nil, fmt.Errorf("no %d response for %s", status, path)
+	}
+	content := d.resolve(d.resolve(response)["content"])
+	media, ok := content[mediaType]
+	if !ok {
+		return nil, fmt.Errorf("no %s content in %d response for %s", mediaType, status, path)
+	}
+	return d.resolve(d.resolve(media)["schema"]), nil
+}
+
+// validate validates value against the subset of the OpenAPI schema object used by our specification.
+func (d openAPIDoc) validate(schema map[string]interface{}, value interface{}, path string) error {
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, s := range oneOf {
+			if d.validate(d.resolve(s), value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: want exactly one schema of oneOf to match %#v, got %d", path, value, matches)
+		}
+		return nil
+	}
+	switch schema["type"] {
+	case "object":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want object, got %T", path, value)
+		}
+		properties := d.resolve(schema["properties"])
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := m[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			property, ok := properties[k]
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: unknown property %q", path, k)
+				}
+				continue
+			}
+			if err := d.validate(d.resolve(property), m[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want array, got %T", path, value)
+		}
+		for i, v := range a {
+			if err := d.validate(d.resolve(schema["items"]), v, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: want string, got %T", path, value)
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == s
+			}
+			if !found {
+				return fmt.Errorf("%s: %q is not one of %v", path, s, enum)
+			}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: want integer, got %#v", path, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: want number, got %T", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: want boolean, got %T", path, value)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported schema type %v", path, schema["type"])
+	}
+	return nil
+}
+
+func TestOpenAPI(t *testing.T) {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPI, &doc); err != nil {
+		t.Fatal(err)
+	}
+	apiServer, server := testServers()
+	defer apiServer.Close()
+	keys, err := auth.Parse([]byte(`{"keys":[{"key":"k1","name":"foo"},{"key":"k2","name":"bar","disabled":true},{"key":"k3","name":"baz","rate":0.1,"burst":1}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Keys = keys
+	server.Anonymous = true
+	server.RateLimiter = ratelimit.New(1, 100, time.Minute)
+	departure := time.Date(2022, 5, 20, 18, 19, 0, 0, time.UTC)
+	server.Vehicles = &source.Fake{AllVehicles: []entur.Vehicle{
+		{ID: "3052", Line: "3", ServiceJourneyID: "ATB:ServiceJourney:3_210811", Latitude: 63.430612, Longitude: 10.394321, Bearing: 271.5, Delay: 94 * time.Second, LastUpdated: departure},
+	}}
+	server.Lines = &source.Fake{AllLines: []entur.Line{{
+		ID:            "ATB:Line:2_21",
+		PublicCode:    "21",
+		Name:          "Pirbadet - Ilsvika",
+		TransportMode: "bus",
+		Routes:        []entur.Route{{Direction: "outbound", Stops: []entur.Place{{Name: "Ilsvika", StopPlace: "NSR:StopPlace:42098"}}}},
+	}}}
+	server.Planner = &source.Fake{Journeys: map[string]entur.ServiceJourney{
+		"ATB:ServiceJourney:21_1113": {
+			ID:   "ATB:ServiceJourney:21_1113",
+			Line: "21",
+			Calls: []entur.Call{{
+				StopPlace:             "NSR:StopPlace:41613",
+				Name:                  "Prinsens gate",
+				Destination:           "Pirbadet via sentrum",
+				AimedArrivalTime:      departure,
+				ExpectedArrivalTime:   departure,
+				AimedDepartureTime:    departure,
+				ExpectedDepartureTime: departure,
+			}},
+		},
+	}, StopTrips: map[[2]int][]entur.Trip{
+		{41613, 42098}: {{
+			StartTime: departure,
+			EndTime:   departure.Add(12 * time.Minute),
+			Duration:  12 * time.Minute,
+			Legs: []entur.Leg{{
+				Mode:              "bus",
+				Line:              "21",
+				Destination:       "Pirbadet via sentrum",
+				From:              entur.Place{Name: "Prinsens gate", StopPlace: "NSR:StopPlace:41613"},
+				To:                entur.Place{Name: "Ilsvika", StopPlace: "NSR:StopPlace:42098"},
+				ExpectedStartTime: departure,
+				ExpectedEndTime:   departure.Add(12 * time.Minute),
+				Distance:          2980,
+			}},
+		}},
+	}}
+	server.Boards, err = board.Parse([]byte(`{"boards":[{"name":"office","stops":[{"id":60890,"direction":"inbound"},{"id":60890,"lines":["21"]}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpSrv := httptest.NewServer(server.Handler())
+	defer httpSrv.Close()
+	failingServer := New(&entur.Client{URL: "http://127.0.0.1:0"}, 168*time.Hour, 1*time.Minute, false)
+	failingSrv := httptest.NewServer(failingServer.Handler())
+	defer failingSrv.Close()
+	log.SetOutput(ioutil.Discard)
+
+	var tests = []struct {
+		server *httptest.Server
+		url    string
+		key    string
+		path   string
+		status int
+	}{
+		{httpSrv, "/", "", "/", 200},
+		{httpSrv, "/openapi.json", "", "/openapi.json", 200},
+		{httpSrv, "/api/v2/departures/60890", "", "/api/v2/departures/{stopId}", 200},
+		{httpSrv, "/api/v2/departures/60890?direction=outbound", "k1", "/api/v2/departures/{stopId}", 200},
+		{httpSrv, "/api/v2/departures/60890?type=arrivals", "", "/api/v2/departures/{stopId}", 200},
+		{httpSrv, "/api/v2/departures/60890?timeFormat=unix", "", "/api/v2/departures/{stopId}", 200},
+		{httpSrv, "/api/v2/departures/foo", "", "/api/v2/departures/{stopId}", 400},
+		{httpSrv, "/api/v2/departures/60890", "k4", "/api/v2/departures/{stopId}", 401},
+		{httpSrv, "/api/v2/departures/60890", "k2", "/api/v2/departures/{stopId}", 403},
+		{httpSrv, "/api/v2/departures/60890", "k3", "/api/v2/departures/{stopId}", 200},
+		{httpSrv, "/api/v2/departures/60890", "k3", "/api/v2/departures/{stopId}", 429},
+		{failingSrv, "/api/v2/departures/60890", "", "/api/v2/departures/{stopId}", 500},
+		{httpSrv, "/api/v2/trips?from=41613&to=42098", "", "/api/v2/trips", 200},
+		{httpSrv, "/api/v2/trips?from=41613", "", "/api/v2/trips", 400},
+		{failingSrv, "/api/v2/trips?from=41613&to=42098", "", "/api/v2/trips", 404},
+		{httpSrv, "/api/v2/journeys/ATB:ServiceJourney:21_1113", "", "/api/v2/journeys/{id}", 200},
+		{httpSrv, "/api/v2/journeys/ATB:ServiceJourney:21_9999", "", "/api/v2/journeys/{id}", 404},
+		{httpSrv, "/api/v2/lines", "", "/api/v2/lines", 200},
+		{httpSrv, "/api/v2/lines/21", "", "/api/v2/lines/{line}", 200},
+		{httpSrv, "/api/v2/lines/99", "", "/api/v2/lines/{line}", 404},
+		{httpSrv, "/api/v2/vehicles?stop=60890", "", "/api/v2/vehicles", 200},
+		{httpSrv, "/api/v2/vehicles?stop=foo", "", "/api/v2/vehicles", 400},
+		{failingSrv, "/api/v2/vehicles", "", "/api/v2/vehicles", 404},
+		{httpSrv, "/api/v2/boards", "", "/api/v2/boards", 200},
+		{failingSrv, "/api/v2/boards", "", "/api/v2/boards", 404},
+		{httpSrv, "/api/v2/boards/office", "", "/api/v2/boards/{name}", 200},
+		{httpSrv, "/api/v2/boards/office?timeFormat=unix", "", "/api/v2/boards/{name}", 200},
+		{httpSrv, "/api/v2/boards/office?timeFormat=foo", "", "/api/v2/boards/{name}", 400},
+		{httpSrv, "/api/v2/boards/home", "", "/api/v2/boards/{name}", 404},
+		{failingSrv, "/api/v2/boards/office", "", "/api/v2/boards/{name}", 404},
+		{httpSrv, "/board/60890", "", "/board/{stops}", 200},
+		{httpSrv, "/board/office?limit=5", "", "/board/{stops}", 200},
+		{httpSrv, "/board/foo,bar", "", "/board/{stops}", 400},
+		{httpSrv, "/board/home", "", "/board/{stops}", 404},
+		{httpSrv, "/board/60890", "k4", "/board/{stops}", 401},
+		{httpSrv, "/api/v3/departures/60890", "", "/api/v3/departures/{stopId}", 200},
+		{httpSrv, "/api/v3/departures/60890?type=arrivals", "", "/api/v3/departures/{stopId}", 200},
+		{httpSrv, "/api/v3/departures/foo", "", "/api/v3/departures/{stopId}", 400},
+		{failingSrv, "/api/v3/departures/60890", "", "/api/v3/departures/{stopId}", 500},
+		{httpSrv, "/api/v2/usage", "k1", "/api/v2/usage", 200},
+		{httpSrv, "/api/v2/usage", "", "/api/v2/usage", 401},
+		{failingSrv, "/api/v2/usage", "", "/api/v2/usage", 404},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.server.URL+tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("want status %d for %s, got %d", tt.status, tt.url, res.StatusCode)
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema, err := doc.responseSchema(tt.path, tt.status, mediaType)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if mediaType != "application/json" {
+			continue // Only JSON responses are validated against the schema
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			t.Fatal(err)
+		}
+		if err := doc.validate(schema, value, "$"); err != nil {
+			t.Errorf("response for %s does not match schema: %s", tt.url, err)
+		}
+	}
+}
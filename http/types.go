@@ -1,9 +1,63 @@
 package http
 
 import (
+	"encoding/json"
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"github.com/mpolden/atb/board"
 	"github.com/mpolden/atb/entur"
 )
 
+const timeLayout = "2006-01-02T15:04:05.000"
+
+// timeFormat controls how times are formatted in responses.
+type timeFormat string
+
+const (
+	// timeFormatLocal formats times in local time without offset, as in the original BusBuddy API.
+	timeFormatLocal timeFormat = "local"
+	// timeFormatRFC3339 formats times as RFC 3339, including offset.
+	timeFormatRFC3339 timeFormat = "rfc3339"
+	// timeFormatUnix formats times as seconds since the Unix epoch.
+	timeFormatUnix timeFormat = "unix"
+)
+
+// parseTimeFormat parses s as a time format. An empty string selects the default local format.
+func parseTimeFormat(s string) (timeFormat, bool) {
+	switch f := timeFormat(s); f {
+	case "":
+		return timeFormatLocal, true
+	case timeFormatLocal, timeFormatRFC3339, timeFormatUnix:
+		return f, true
+	}
+	return "", false
+}
+
+// format formats t according to f.
+func (f timeFormat) format(t time.Time) Time {
+	switch f {
+	case timeFormatRFC3339:
+		return Time(t.Format(time.RFC3339))
+	case timeFormatUnix:
+		return Time(strconv.FormatInt(t.Unix(), 10))
+	}
+	return Time(t.Format(timeLayout))
+}
+
+// Time is a time formatted according to the timeFormat of a request.
+type Time string
+
+// MarshalJSON marshals t as a JSON number if it is formatted as seconds since the Unix epoch, and as a JSON string
+// otherwise.
+func (t Time) MarshalJSON() ([]byte, error) {
+	if _, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+		return []byte(t), nil
+	}
+	return json.Marshal(string(t))
+}
+
 // BusStops represents a list of bus stops.
 type BusStops struct {
 	Stops   []BusStop `json:"stops"`
@@ -24,49 +78,622 @@ type BusStop struct {
 
 // Departures represents a list of departures, from a given bus stop.
 type Departures struct {
-	URL            string      `json:"url"`
-	TowardsCentrum *bool       `json:"isGoingTowardsCentrum,omitempty"`
-	Departures     []Departure `json:"departures"`
+	XMLName        xml.Name    `json:"-" xml:"departures"`
+	URL            string      `json:"url" xml:"url"`
+	ServerTime     Time        `json:"serverTime" xml:"serverTime"`
+	TowardsCentrum *bool       `json:"isGoingTowardsCentrum,omitempty" xml:"isGoingTowardsCentrum,omitempty"`
+	Departures     []Departure `json:"departures" xml:"departure"`
+	arrivals       bool
 }
 
 // Departure represents a single departure in a given direction.
 type Departure struct {
-	LineID                  string `json:"line"`
-	RegisteredDepartureTime string `json:"registeredDepartureTime,omitempty"`
-	ScheduledDepartureTime  string `json:"scheduledDepartureTime"`
-	Destination             string `json:"destination"`
-	IsRealtimeData          bool   `json:"isRealtimeData"`
-	TowardsCentrum          *bool  `json:"isGoingTowardsCentrum,omitempty"`
+	LineID                  string `json:"line" xml:"line"`
+	ScheduledArrivalTime    Time   `json:"scheduledArrivalTime,omitempty" xml:"scheduledArrivalTime,omitempty"`
+	RegisteredDepartureTime Time   `json:"registeredDepartureTime,omitempty" xml:"registeredDepartureTime,omitempty"`
+	ScheduledDepartureTime  Time   `json:"scheduledDepartureTime" xml:"scheduledDepartureTime"`
+	Destination             string `json:"destination" xml:"destination"`
+	IsRealtimeData          bool   `json:"isRealtimeData" xml:"isRealtimeData"`
+	IsCancelled             bool   `json:"isCancelled,omitempty" xml:"isCancelled,omitempty"`
+	TowardsCentrum          *bool  `json:"isGoingTowardsCentrum,omitempty" xml:"isGoingTowardsCentrum,omitempty"`
+	ServiceJourneyID        string `json:"serviceJourneyId,omitempty" xml:"serviceJourneyId,omitempty"`
+	SecondsUntilDeparture   int    `json:"secondsUntilDeparture" xml:"secondsUntilDeparture"`
+	MinutesUntilDeparture   int    `json:"minutesUntilDeparture" xml:"minutesUntilDeparture"`
+	DisplayTime             string `json:"displayTime" xml:"displayTime"`
+}
+
+// Trips represents a list of suggested trips between two stops.
+type Trips struct {
+	XMLName xml.Name `json:"-" xml:"trips"`
+	URL     string   `json:"url" xml:"url"`
+	Trips   []Trip   `json:"trips" xml:"trip"`
+}
+
+// Trip represents a single suggested trip, consisting of one or more legs.
+type Trip struct {
+	ScheduledDepartureTime Time    `json:"scheduledDepartureTime" xml:"scheduledDepartureTime"`
+	ScheduledArrivalTime   Time    `json:"scheduledArrivalTime" xml:"scheduledArrivalTime"`
+	Duration               int     `json:"duration" xml:"duration"`
+	WalkDistance           float64 `json:"walkDistance" xml:"walkDistance"`
+	Legs                   []Leg   `json:"legs" xml:"leg"`
+}
+
+// Leg represents a part of a trip. Walking legs have mode foot and no line.
+type Leg struct {
+	Mode                   string  `json:"mode" xml:"mode"`
+	LineID                 string  `json:"line,omitempty" xml:"line,omitempty"`
+	Destination            string  `json:"destination,omitempty" xml:"destination,omitempty"`
+	From                   Place   `json:"from" xml:"from"`
+	To                     Place   `json:"to" xml:"to"`
+	ScheduledDepartureTime Time    `json:"scheduledDepartureTime" xml:"scheduledDepartureTime"`
+	ScheduledArrivalTime   Time    `json:"scheduledArrivalTime" xml:"scheduledArrivalTime"`
+	Distance               float64 `json:"distance" xml:"distance"`
+	IsRealtimeData         bool    `json:"isRealtimeData" xml:"isRealtimeData"`
+}
+
+// Place represents the start or end of a leg. StopID is omitted if the place is not a stop.
+type Place struct {
+	StopID int    `json:"stopId,omitempty" xml:"stopId,omitempty"`
+	Name   string `json:"name" xml:"name"`
+}
+
+// Journey represents a service journey, i.e. a single run of a vehicle along a line.
+type Journey struct {
+	XMLName xml.Name `json:"-" xml:"journey"`
+	URL     string   `json:"url" xml:"url"`
+	ID      string   `json:"id" xml:"id"`
+	LineID  string   `json:"line" xml:"line"`
+	Calls   []Call   `json:"calls" xml:"call"`
+}
+
+// Call represents a visit by a journey to a stop.
+type Call struct {
+	StopID                int    `json:"stopId" xml:"stopId"`
+	Name                  string `json:"name" xml:"name"`
+	Destination           string `json:"destination" xml:"destination"`
+	AimedArrivalTime      Time   `json:"aimedArrivalTime" xml:"aimedArrivalTime"`
+	ExpectedArrivalTime   Time   `json:"expectedArrivalTime" xml:"expectedArrivalTime"`
+	AimedDepartureTime    Time   `json:"aimedDepartureTime" xml:"aimedDepartureTime"`
+	ExpectedDepartureTime Time   `json:"expectedDepartureTime" xml:"expectedDepartureTime"`
+	IsRealtimeData        bool   `json:"isRealtimeData" xml:"isRealtimeData"`
+	IsCancelled           bool   `json:"isCancelled" xml:"isCancelled"`
+}
+
+// Lines represents a list of lines.
+type Lines struct {
+	XMLName xml.Name `json:"-" xml:"lines"`
+	URL     string   `json:"url" xml:"url"`
+	Lines   []Line   `json:"lines" xml:"line"`
+}
+
+// Line represents a single line. Routes are only included when requesting a single line.
+type Line struct {
+	XMLName       xml.Name `json:"-" xml:"line"`
+	URL           string   `json:"url" xml:"url"`
+	ID            string   `json:"id" xml:"id"`
+	LineID        string   `json:"line" xml:"publicCode"`
+	Name          string   `json:"name" xml:"name"`
+	TransportMode string   `json:"transportMode" xml:"transportMode"`
+	Colour        string   `json:"colour,omitempty" xml:"colour,omitempty"`
+	TextColour    string   `json:"textColour,omitempty" xml:"textColour,omitempty"`
+	Operator      string   `json:"operator,omitempty" xml:"operator,omitempty"`
+	Routes        []Route  `json:"routes,omitempty" xml:"route,omitempty"`
+}
+
+// Route represents the stops served by a line in one direction.
+type Route struct {
+	Direction string  `json:"direction" xml:"direction"`
+	Stops     []Place `json:"stops" xml:"stop"`
+}
+
+// Vehicles represents a list of vehicle positions.
+type Vehicles struct {
+	XMLName  xml.Name  `json:"-" xml:"vehicles"`
+	URL      string    `json:"url" xml:"url"`
+	Vehicles []Vehicle `json:"vehicles" xml:"vehicle"`
+}
+
+// Vehicle represents the last known position of a vehicle. Delay is given in seconds.
+type Vehicle struct {
+	ID               string  `json:"id" xml:"id"`
+	LineID           string  `json:"line" xml:"line"`
+	ServiceJourneyID string  `json:"serviceJourneyId,omitempty" xml:"serviceJourneyId,omitempty"`
+	Destination      string  `json:"destination,omitempty" xml:"destination,omitempty"`
+	Latitude         float64 `json:"latitude" xml:"latitude"`
+	Longitude        float64 `json:"longitude" xml:"longitude"`
+	Bearing          float64 `json:"bearing" xml:"bearing"`
+	Delay            int     `json:"delay" xml:"delay"`
+	LastUpdated      Time    `json:"lastUpdated" xml:"lastUpdated"`
 }
 
 // Error represents an error in the API, which is returned to the user.
 type Error struct {
+	XMLName xml.Name `json:"-" xml:"error"`
 	err     error
-	Status  int    `json:"status"`
-	Message string `json:"message"`
+	Status  int    `json:"status" xml:"status"`
+	Message string `json:"message" xml:"message"`
+}
+
+func formatBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+// clock returns the time of day in s, formatted as HH:MM. s is returned unchanged if it cannot be parsed.
+func clock(s Time) string {
+	for _, layout := range []string{timeLayout, time.RFC3339} {
+		if t, err := time.Parse(layout, string(s)); err == nil {
+			return t.Format("15:04")
+		}
+	}
+	return string(s)
+}
+
+func (d Departures) table(compact bool) ([]string, [][]string) {
+	if compact {
+		rows := make([][]string, 0, len(d.Departures))
+		for _, dep := range d.Departures {
+			departureTime := clock(dep.ScheduledDepartureTime)
+			if d.arrivals {
+				departureTime = clock(dep.ScheduledArrivalTime)
+			}
+			if dep.IsCancelled {
+				departureTime = entur.CancelledDisplayTime
+			} else if !dep.IsRealtimeData {
+				departureTime = "ca. " + departureTime
+			}
+			rows = append(rows, []string{dep.LineID, departureTime, dep.Destination})
+		}
+		return []string{"line", "time", "destination"}, rows
+	}
+	rows := make([][]string, 0, len(d.Departures))
+	for _, dep := range d.Departures {
+		row := []string{dep.LineID}
+		if d.arrivals {
+			row = append(row, string(dep.ScheduledArrivalTime))
+		}
+		rows = append(rows, append(row,
+			string(dep.RegisteredDepartureTime),
+			string(dep.ScheduledDepartureTime),
+			dep.Destination,
+			strconv.FormatBool(dep.IsRealtimeData),
+			formatBool(dep.TowardsCentrum),
+		))
+	}
+	header := []string{"line", "registeredDepartureTime", "scheduledDepartureTime", "destination", "isRealtimeData", "isGoingTowardsCentrum"}
+	if d.arrivals {
+		header = append([]string{"line", "scheduledArrivalTime"}, header[1:]...)
+	}
+	return header, rows
+}
+
+func (t Trips) table(compact bool) ([]string, [][]string) {
+	var rows [][]string
+	for i, trip := range t.Trips {
+		for _, leg := range trip.Legs {
+			if compact {
+				line := leg.LineID
+				if line == "" {
+					line = leg.Mode
+				}
+				rows = append(rows, []string{
+					strconv.Itoa(i + 1),
+					line,
+					leg.From.Name,
+					clock(leg.ScheduledDepartureTime),
+					leg.To.Name,
+					clock(leg.ScheduledArrivalTime),
+				})
+				continue
+			}
+			rows = append(rows, []string{
+				strconv.Itoa(i + 1),
+				leg.Mode,
+				leg.LineID,
+				leg.Destination,
+				leg.From.Name,
+				leg.To.Name,
+				string(leg.ScheduledDepartureTime),
+				string(leg.ScheduledArrivalTime),
+				strconv.FormatFloat(leg.Distance, 'f', -1, 64),
+				strconv.FormatBool(leg.IsRealtimeData),
+			})
+		}
+	}
+	if compact {
+		return []string{"trip", "line", "from", "departure", "to", "arrival"}, rows
+	}
+	return []string{"trip", "mode", "line", "destination", "from", "to", "scheduledDepartureTime", "scheduledArrivalTime", "distance", "isRealtimeData"}, rows
+}
+
+func (j Journey) table(compact bool) ([]string, [][]string) {
+	rows := make([][]string, 0, len(j.Calls))
+	for _, c := range j.Calls {
+		if compact {
+			departureTime := clock(c.ExpectedDepartureTime)
+			if c.IsCancelled {
+				departureTime = "cancelled"
+			} else if !c.IsRealtimeData {
+				departureTime = "ca. " + departureTime
+			}
+			rows = append(rows, []string{c.Name, departureTime})
+			continue
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(c.StopID),
+			c.Name,
+			c.Destination,
+			string(c.AimedArrivalTime),
+			string(c.ExpectedArrivalTime),
+			string(c.AimedDepartureTime),
+			string(c.ExpectedDepartureTime),
+			strconv.FormatBool(c.IsRealtimeData),
+			strconv.FormatBool(c.IsCancelled),
+		})
+	}
+	if compact {
+		return []string{"stop", "time"}, rows
+	}
+	return []string{"stopId", "name", "destination", "aimedArrivalTime", "expectedArrivalTime", "aimedDepartureTime", "expectedDepartureTime", "isRealtimeData", "isCancelled"}, rows
+}
+
+func (l Lines) table(compact bool) ([]string, [][]string) {
+	rows := make([][]string, 0, len(l.Lines))
+	for _, line := range l.Lines {
+		if compact {
+			rows = append(rows, []string{line.LineID, line.Name})
+			continue
+		}
+		rows = append(rows, []string{line.LineID, line.ID, line.Name, line.TransportMode, line.Colour, line.TextColour, line.Operator})
+	}
+	if compact {
+		return []string{"line", "name"}, rows
+	}
+	return []string{"line", "id", "name", "transportMode", "colour", "textColour", "operator"}, rows
+}
+
+func (l Line) table(compact bool) ([]string, [][]string) {
+	var rows [][]string
+	for _, r := range l.Routes {
+		for _, stop := range r.Stops {
+			if compact {
+				rows = append(rows, []string{r.Direction, stop.Name})
+				continue
+			}
+			rows = append(rows, []string{r.Direction, strconv.Itoa(stop.StopID), stop.Name})
+		}
+	}
+	if compact {
+		return []string{"direction", "stop"}, rows
+	}
+	return []string{"direction", "stopId", "name"}, rows
 }
 
-func convertDepartures(enturDepartures []entur.Departure) Departures {
+func (v Vehicles) table(compact bool) ([]string, [][]string) {
+	rows := make([][]string, 0, len(v.Vehicles))
+	for _, vehicle := range v.Vehicles {
+		if compact {
+			rows = append(rows, []string{vehicle.LineID, vehicle.Destination, strconv.Itoa(vehicle.Delay)})
+			continue
+		}
+		rows = append(rows, []string{
+			vehicle.ID,
+			vehicle.LineID,
+			vehicle.ServiceJourneyID,
+			vehicle.Destination,
+			strconv.FormatFloat(vehicle.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(vehicle.Longitude, 'f', -1, 64),
+			strconv.FormatFloat(vehicle.Bearing, 'f', -1, 64),
+			strconv.Itoa(vehicle.Delay),
+			string(vehicle.LastUpdated),
+		})
+	}
+	if compact {
+		return []string{"line", "destination", "delay"}, rows
+	}
+	return []string{"id", "line", "serviceJourneyId", "destination", "latitude", "longitude", "bearing", "delay", "lastUpdated"}, rows
+}
+
+func (e *Error) table(compact bool) ([]string, [][]string) {
+	return []string{"status", "message"}, [][]string{{strconv.Itoa(e.Status), e.Message}}
+}
+
+func convertDepartures(enturDepartures []entur.Departure, arrivals bool, now time.Time, tf timeFormat) Departures {
 	departures := make([]Departure, 0, len(enturDepartures))
-	const timeLayout = "2006-01-02T15:04:05.000"
 	for _, d := range enturDepartures {
-		scheduledDepartureTime := d.ScheduledDepartureTime.Format(timeLayout)
-		registeredDepartureTime := ""
+		t := d.ScheduledDepartureTime
+		if arrivals && !d.ExpectedArrivalTime.IsZero() {
+			t = d.ExpectedArrivalTime
+		}
+		secondsUntil := int(t.Sub(now) / time.Second)
+		if secondsUntil < 0 {
+			secondsUntil = 0
+		}
+		scheduledDepartureTime := tf.format(d.ScheduledDepartureTime)
+		var registeredDepartureTime Time
 		if !d.RegisteredDepartureTime.IsZero() {
-			registeredDepartureTime = d.RegisteredDepartureTime.Format(timeLayout)
+			registeredDepartureTime = tf.format(d.RegisteredDepartureTime)
+		}
+		var scheduledArrivalTime Time
+		if arrivals && !d.ExpectedArrivalTime.IsZero() {
+			scheduledArrivalTime = tf.format(d.ExpectedArrivalTime)
+		}
+		displayTime := entur.DisplayTime(t, now)
+		if d.IsCancelled {
+			displayTime = entur.CancelledDisplayTime
 		}
 		towardsCentrum := d.Inbound
 		departure := Departure{
 			LineID:                  d.Line,
+			ScheduledArrivalTime:    scheduledArrivalTime,
 			ScheduledDepartureTime:  scheduledDepartureTime,
 			RegisteredDepartureTime: registeredDepartureTime,
 			Destination:             d.Destination,
 			IsRealtimeData:          d.IsRealtime,
+			IsCancelled:             d.IsCancelled,
 			TowardsCentrum:          &towardsCentrum,
+			ServiceJourneyID:        d.ServiceJourneyID,
+			SecondsUntilDeparture:   secondsUntil,
+			MinutesUntilDeparture:   secondsUntil / 60,
+			DisplayTime:             displayTime,
 		}
 		departures = append(departures, departure)
 	}
+	// Format server time in the same location as departures, which is local to the stop
+	if len(enturDepartures) > 0 {
+		now = now.In(enturDepartures[0].ScheduledDepartureTime.Location())
+	}
 	return Departures{
+		ServerTime: tf.format(now),
+		Departures: departures,
+		arrivals:   arrivals,
+	}
+}
+
+func convertPlace(p entur.Place) Place {
+	stopID, _ := parseStopRef(p.StopPlace)
+	return Place{StopID: stopID, Name: p.Name}
+}
+
+func convertTrips(enturTrips []entur.Trip, tf timeFormat) Trips {
+	trips := make([]Trip, 0, len(enturTrips))
+	for _, t := range enturTrips {
+		legs := make([]Leg, 0, len(t.Legs))
+		for _, l := range t.Legs {
+			legs = append(legs, Leg{
+				Mode:                   l.Mode,
+				LineID:                 l.Line,
+				Destination:            l.Destination,
+				From:                   convertPlace(l.From),
+				To:                     convertPlace(l.To),
+				ScheduledDepartureTime: tf.format(l.ExpectedStartTime),
+				ScheduledArrivalTime:   tf.format(l.ExpectedEndTime),
+				Distance:               l.Distance,
+				IsRealtimeData:         l.IsRealtime,
+			})
+		}
+		trips = append(trips, Trip{
+			ScheduledDepartureTime: tf.format(t.StartTime),
+			ScheduledArrivalTime:   tf.format(t.EndTime),
+			Duration:               int(t.Duration.Seconds()),
+			WalkDistance:           t.WalkDistance,
+			Legs:                   legs,
+		})
+	}
+	return Trips{Trips: trips}
+}
+
+func convertJourney(sj entur.ServiceJourney, tf timeFormat) Journey {
+	calls := make([]Call, 0, len(sj.Calls))
+	for _, c := range sj.Calls {
+		stopID, _ := parseStopRef(c.StopPlace)
+		calls = append(calls, Call{
+			StopID:                stopID,
+			Name:                  c.Name,
+			Destination:           c.Destination,
+			AimedArrivalTime:      tf.format(c.AimedArrivalTime),
+			ExpectedArrivalTime:   tf.format(c.ExpectedArrivalTime),
+			AimedDepartureTime:    tf.format(c.AimedDepartureTime),
+			ExpectedDepartureTime: tf.format(c.ExpectedDepartureTime),
+			IsRealtimeData:        c.IsRealtime,
+			IsCancelled:           c.IsCancelled,
+		})
+	}
+	return Journey{ID: sj.ID, LineID: sj.Line, Calls: calls}
+}
+
+func convertLine(l entur.Line) Line {
+	routes := make([]Route, 0, len(l.Routes))
+	for _, r := range l.Routes {
+		stops := make([]Place, 0, len(r.Stops))
+		for _, stop := range r.Stops {
+			stops = append(stops, convertPlace(stop))
+		}
+		routes = append(routes, Route{Direction: r.Direction, Stops: stops})
+	}
+	return Line{
+		ID:            l.ID,
+		LineID:        l.PublicCode,
+		Name:          l.Name,
+		TransportMode: l.TransportMode,
+		Colour:        l.Colour,
+		TextColour:    l.TextColour,
+		Operator:      l.Operator,
+		Routes:        routes,
+	}
+}
+
+func convertVehicle(v entur.Vehicle, tf timeFormat) Vehicle {
+	return Vehicle{
+		ID:               v.ID,
+		LineID:           v.Line,
+		ServiceJourneyID: v.ServiceJourneyID,
+		Destination:      v.Destination,
+		Latitude:         v.Latitude,
+		Longitude:        v.Longitude,
+		Bearing:          v.Bearing,
+		Delay:            int(v.Delay.Seconds()),
+		LastUpdated:      tf.format(v.LastUpdated),
+	}
+}
+
+// Departure statuses in the v3 API.
+const (
+	statusScheduled = "scheduled"
+	statusOnTime    = "onTime"
+	statusDelayed   = "delayed"
+	statusDeparted  = "departed"
+	statusCancelled = "cancelled"
+)
+
+// NamedBoards represents a list of named boards.
+type NamedBoards struct {
+	URL    string           `json:"url"`
+	Boards []NamedBoardInfo `json:"boards"`
+}
+
+// NamedBoardInfo represents the definition of a named board.
+type NamedBoardInfo struct {
+	URL string `json:"url"`
+	board.Board
+}
+
+// NamedBoard represents departures from the stops of a named board.
+type NamedBoard struct {
+	URL        string           `json:"url"`
+	Name       string           `json:"name"`
+	ServerTime Time             `json:"serverTime"`
+	Stops      []NamedBoardStop `json:"stops"`
+}
+
+// NamedBoardStop represents departures from a single stop of a named board, filtered as configured for the stop.
+type NamedBoardStop struct {
+	URL string `json:"url"`
+	board.Stop
+	Departures []Departure `json:"departures"`
+}
+
+// DeparturesV3 represents departures from a stop in the v3 API.
+type DeparturesV3 struct {
+	URL        string        `json:"url"`
+	ServerTime time.Time     `json:"serverTime"`
+	Stop       StopV3        `json:"stop"`
+	Departures []DepartureV3 `json:"departures"`
+	Situations []SituationV3 `json:"situations"`
+}
+
+// StopV3 represents a stop place in the v3 API.
+type StopV3 struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// LineV3 represents the line of a departure in the v3 API.
+type LineV3 struct {
+	ID            string `json:"id"`
+	PublicCode    string `json:"publicCode"`
+	TransportMode string `json:"transportMode,omitempty"`
+}
+
+// DepartureV3 represents a single departure in the v3 API. All times include a UTC offset.
+type DepartureV3 struct {
+	Line                  LineV3     `json:"line"`
+	Quay                  string     `json:"quay"`
+	Destination           string     `json:"destination"`
+	Direction             string     `json:"direction"`
+	ServiceJourneyID      string     `json:"serviceJourneyId"`
+	AimedArrivalTime      *time.Time `json:"aimedArrivalTime,omitempty"`
+	ExpectedArrivalTime   *time.Time `json:"expectedArrivalTime,omitempty"`
+	AimedDepartureTime    *time.Time `json:"aimedDepartureTime,omitempty"`
+	ExpectedDepartureTime time.Time  `json:"expectedDepartureTime"`
+	ActualDepartureTime   *time.Time `json:"actualDepartureTime,omitempty"`
+	Status                string     `json:"status"`
+}
+
+// SituationV3 represents a disruption affecting a stop in the v3 API.
+type SituationV3 struct {
+	ID          string     `json:"id"`
+	Summary     string     `json:"summary"`
+	Description string     `json:"description,omitempty"`
+	Severity    string     `json:"severity,omitempty"`
+	ValidFrom   *time.Time `json:"validFrom,omitempty"`
+	ValidTo     *time.Time `json:"validTo,omitempty"`
+}
+
+// optionalTime returns a pointer to t, or nil if t is the zero time.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// departureStatus returns the status of departure d.
+func departureStatus(d entur.Departure) string {
+	switch {
+	case d.IsCancelled:
+		return statusCancelled
+	case !d.RegisteredDepartureTime.IsZero():
+		return statusDeparted
+	case !d.IsRealtime:
+		return statusScheduled
+	case d.Delayed():
+		return statusDelayed
+	}
+	return statusOnTime
+}
+
+func convertDepartureV3(d entur.Departure) DepartureV3 {
+	direction := outbound
+	if d.Inbound {
+		direction = inbound
+	}
+	return DepartureV3{
+		Line:                  LineV3{ID: d.LineID, PublicCode: d.Line, TransportMode: d.TransportMode},
+		Quay:                  d.Quay,
+		Destination:           d.Destination,
+		Direction:             direction,
+		ServiceJourneyID:      d.ServiceJourneyID,
+		AimedArrivalTime:      optionalTime(d.AimedArrivalTime),
+		ExpectedArrivalTime:   optionalTime(d.ExpectedArrivalTime),
+		AimedDepartureTime:    optionalTime(d.AimedDepartureTime),
+		ExpectedDepartureTime: d.ScheduledDepartureTime,
+		ActualDepartureTime:   optionalTime(d.RegisteredDepartureTime),
+		Status:                departureStatus(d),
+	}
+}
+
+func convertSituationV3(s entur.Situation) SituationV3 {
+	return SituationV3{
+		ID:          s.ID,
+		Summary:     s.Summary,
+		Description: s.Description,
+		Severity:    s.Severity,
+		ValidFrom:   optionalTime(s.ValidFrom),
+		ValidTo:     optionalTime(s.ValidTo),
+	}
+}
+
+func convertDeparturesV3(stop entur.Stop, enturDepartures []entur.Departure, situations []entur.Situation, direction string, now time.Time) DeparturesV3 {
+	departures := make([]DepartureV3, 0, len(enturDepartures))
+	for _, d := range enturDepartures {
+		if (direction == inbound && !d.Inbound) || (direction == outbound && d.Inbound) {
+			continue
+		}
+		departures = append(departures, convertDepartureV3(d))
+	}
+	convertedSituations := make([]SituationV3, 0, len(situations))
+	for _, s := range situations {
+		convertedSituations = append(convertedSituations, convertSituationV3(s))
+	}
+	return DeparturesV3{
+		ServerTime: now,
+		Stop:       StopV3{ID: stop.ID, Name: stop.Name, Latitude: stop.Latitude, Longitude: stop.Longitude},
 		Departures: departures,
+		Situations: convertedSituations,
 	}
 }
@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket rate limiter that keeps a separate bucket for each key. Buckets use the rate and burst of the
+// limiter, unless they are given per key with AllowRate.
+type Limiter struct {
+	rate          float64
+	burst         float64
+	buckets       map[string]*bucket
+	evictInterval time.Duration
+	evicted       time.Time
+	now           func() time.Time
+	mu            sync.Mutex
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	rate    float64
+	burst   float64
+}
+
+// New creates a new limiter which allows rate events per second for each key, with bursts of at most burst events.
+// Idle buckets are evicted by the first event after evictInterval has passed since the previous eviction.
+func New(rate float64, burst int, evictInterval time.Duration) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:          rate,
+		burst:         float64(burst),
+		buckets:       make(map[string]*bucket),
+		evictInterval: evictInterval,
+		now:           time.Now,
+	}
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// evictIdle removes idle buckets if evictInterval has passed since the previous eviction. The caller must hold mu.
+func (l *Limiter) evictIdle(now time.Time) {
+	if now.Sub(l.evicted) < l.evictInterval {
+		return
+	}
+	l.evicted = now
+	for k, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= b.burst {
+			delete(l.buckets, k) // A full bucket is equivalent to no bucket
+		}
+	}
+}
+
+// Len returns the number of buckets currently tracked by the limiter.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// Allow reports whether an event for key may happen now. If not, the returned duration is the time until the next
+// event for key is allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.allow(key, l.rate, l.burst)
+}
+
+// AllowRate is like Allow, but allows rate events per second for key, with bursts of at most burst events, instead of
+// using the rate and burst of the limiter.
+func (l *Limiter) AllowRate(key string, rate float64, burst int) (bool, time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+	return l.allow(key, rate, float64(burst))
+}
+
+func (l *Limiter) allow(key string, rate, burst float64) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.evictIdle(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.rate, b.burst = rate, burst
+	l.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := (1 - b.tokens) / rate
+	return false, time.Duration(wait * float64(time.Second))
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := New(2, 3, time.Hour)
+	l.now = func() time.Time { return now }
+	var tests = []struct {
+		key       string
+		nowOffset time.Duration
+		ok        bool
+		wait      time.Duration
+	}{
+		{"k1", 0, true, 0},
+		{"k1", 0, true, 0},
+		{"k1", 0, true, 0},
+		{"k1", 0, false, 500 * time.Millisecond},
+		{"k2", 0, true, 0}, // Separate bucket
+		{"k1", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"k1", 500 * time.Millisecond, true, 0},
+		{"k1", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"k1", 10 * time.Second, true, 0}, // Refills up to burst
+		{"k1", 10 * time.Second, true, 0},
+		{"k1", 10 * time.Second, true, 0},
+		{"k1", 10 * time.Second, false, 500 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		l.now = func() time.Time { return now.Add(tt.nowOffset) }
+		ok, wait := l.Allow(tt.key)
+		if ok != tt.ok || wait != tt.wait {
+			t.Errorf("#%d: Allow(%q) = (%t, %s), want (%t, %s)", i, tt.key, ok, wait, tt.ok, tt.wait)
+		}
+	}
+	if got, want := l.Len(), 2; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	l.now = func() time.Time { return now.Add(time.Hour) }
+	l.Allow("k3") // Evicts idle buckets, as the evict interval has passed
+	if got, want := l.Len(), 1; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
+
+func TestAllowRate(t *testing.T) {
+	now := time.Now()
+	l := New(100, 100, time.Hour)
+	l.now = func() time.Time { return now }
+	var tests = []struct {
+		key       string
+		rate      float64
+		burst     int
+		nowOffset time.Duration
+		ok        bool
+		wait      time.Duration
+	}{
+		{"k1", 1, 2, 0, true, 0},
+		{"k1", 1, 2, 0, true, 0},
+		{"k1", 1, 2, 0, false, time.Second},
+		{"k2", 4, 1, 0, true, 0}, // Separate bucket with its own rate
+		{"k2", 4, 1, 0, false, 250 * time.Millisecond},
+		{"k2", 4, 1, 250 * time.Millisecond, true, 0},
+		{"k1", 1, 2, 10 * time.Second, true, 0}, // Refills up to burst of key
+		{"k1", 1, 2, 10 * time.Second, true, 0},
+		{"k1", 1, 2, 10 * time.Second, false, time.Second},
+	}
+	for i, tt := range tests {
+		l.now = func() time.Time { return now.Add(tt.nowOffset) }
+		ok, wait := l.AllowRate(tt.key, tt.rate, tt.burst)
+		if ok != tt.ok || wait != tt.wait {
+			t.Errorf("#%d: AllowRate(%q, %g, %d) = (%t, %s), want (%t, %s)", i, tt.key, tt.rate, tt.burst, ok, wait, tt.ok, tt.wait)
+		}
+	}
+	l.now = func() time.Time { return now.Add(time.Minute) }
+	l.Allow("k3") // Evict interval has not passed
+	if got, want := l.Len(), 3; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+	l.now = func() time.Time { return now.Add(time.Hour) }
+	l.Allow("k3")
+	if got, want := l.Len(), 1; got != want {
+		t.Errorf("Len() = %d, want %d", got, want)
+	}
+}
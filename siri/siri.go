@@ -0,0 +1,124 @@
+package siri
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/mpolden/atb/entur"
+)
+
+// Namespace is the XML namespace of SIRI documents.
+const Namespace = "http://www.siri.org.uk/siri"
+
+// Version is the SIRI version of documents produced by this package.
+const Version = "2.0"
+
+// Siri is the root element of a SIRI document.
+type Siri struct {
+	XMLName         xml.Name        `xml:"http://www.siri.org.uk/siri Siri"`
+	Version         string          `xml:"version,attr"`
+	ServiceDelivery ServiceDelivery `xml:"ServiceDelivery"`
+}
+
+// ServiceDelivery contains the response to a SIRI service request.
+type ServiceDelivery struct {
+	ResponseTimestamp      time.Time              `xml:"ResponseTimestamp"`
+	ProducerRef            string                 `xml:"ProducerRef"`
+	StopMonitoringDelivery StopMonitoringDelivery `xml:"StopMonitoringDelivery"`
+}
+
+// StopMonitoringDelivery contains the vehicles visiting a monitored stop.
+type StopMonitoringDelivery struct {
+	Version            string               `xml:"version,attr"`
+	ResponseTimestamp  time.Time            `xml:"ResponseTimestamp"`
+	MonitoredStopVisit []MonitoredStopVisit `xml:"MonitoredStopVisit"`
+}
+
+// MonitoredStopVisit is a visit of a vehicle to a monitored stop.
+type MonitoredStopVisit struct {
+	RecordedAtTime          time.Time               `xml:"RecordedAtTime"`
+	MonitoringRef           string                  `xml:"MonitoringRef"`
+	MonitoredVehicleJourney MonitoredVehicleJourney `xml:"MonitoredVehicleJourney"`
+}
+
+// MonitoredVehicleJourney describes the journey of the vehicle visiting a stop.
+type MonitoredVehicleJourney struct {
+	LineRef           string        `xml:"LineRef"`
+	DirectionRef      string        `xml:"DirectionRef"`
+	VehicleMode       string        `xml:"VehicleMode,omitempty"`
+	PublishedLineName string        `xml:"PublishedLineName"`
+	OperatorRef       string        `xml:"OperatorRef,omitempty"`
+	DestinationName   string        `xml:"DestinationName"`
+	Monitored         bool          `xml:"Monitored"`
+	Cancellation      bool          `xml:"Cancellation,omitempty"`
+	MonitoredCall     MonitoredCall `xml:"MonitoredCall"`
+}
+
+// MonitoredCall describes the call of a vehicle at a monitored stop.
+type MonitoredCall struct {
+	StopPointRef          string     `xml:"StopPointRef,omitempty"`
+	AimedDepartureTime    *time.Time `xml:"AimedDepartureTime,omitempty"`
+	ExpectedDepartureTime *time.Time `xml:"ExpectedDepartureTime,omitempty"`
+	ActualDepartureTime   *time.Time `xml:"ActualDepartureTime,omitempty"`
+	DepartureStatus       string     `xml:"DepartureStatus,omitempty"`
+}
+
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// StopMonitoring creates a SIRI document containing a StopMonitoringDelivery of departures from the stop identified by
+// monitoringRef. The time now is used as response timestamp.
+func StopMonitoring(monitoringRef string, departures []entur.Departure, now time.Time) *Siri {
+	visits := make([]MonitoredStopVisit, 0, len(departures))
+	for _, d := range departures {
+		direction := "outbound"
+		if d.Inbound {
+			direction = "inbound"
+		}
+		lineRef := d.LineID
+		if lineRef == "" {
+			lineRef = d.Line
+		}
+		departureStatus := ""
+		if d.IsCancelled {
+			departureStatus = "cancelled"
+		}
+		visits = append(visits, MonitoredStopVisit{
+			RecordedAtTime: now,
+			MonitoringRef:  monitoringRef,
+			MonitoredVehicleJourney: MonitoredVehicleJourney{
+				LineRef:           lineRef,
+				DirectionRef:      direction,
+				VehicleMode:       d.TransportMode,
+				PublishedLineName: d.Line,
+				OperatorRef:       d.Operator,
+				DestinationName:   d.Destination,
+				Monitored:         d.IsRealtime,
+				Cancellation:      d.IsCancelled,
+				MonitoredCall: MonitoredCall{
+					StopPointRef:          d.Quay,
+					AimedDepartureTime:    timeRef(d.AimedDepartureTime),
+					ExpectedDepartureTime: timeRef(d.ScheduledDepartureTime),
+					ActualDepartureTime:   timeRef(d.RegisteredDepartureTime),
+					DepartureStatus:       departureStatus,
+				},
+			},
+		})
+	}
+	return &Siri{
+		Version: Version,
+		ServiceDelivery: ServiceDelivery{
+			ResponseTimestamp: now,
+			ProducerRef:       "atb",
+			StopMonitoringDelivery: StopMonitoringDelivery{
+				Version:            Version,
+				ResponseTimestamp:  now,
+				MonitoredStopVisit: visits,
+			},
+		},
+	}
+}
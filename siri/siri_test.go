@@ -0,0 +1,70 @@
+package siri
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/mpolden/atb/entur"
+)
+
+func TestStopMonitoring(t *testing.T) {
+	cest := time.FixedZone("CEST", 7200)
+	departures := []entur.Departure{
+		{
+			Line:                   "21",
+			LineID:                 "ATB:Line:2_21",
+			TransportMode:          "bus",
+			Operator:               "ATB:Operator:171",
+			Quay:                   "NSR:Quay:73154",
+			AimedDepartureTime:     time.Date(2022, 5, 20, 18, 18, 0, 0, cest),
+			ScheduledDepartureTime: time.Date(2022, 5, 20, 18, 19, 0, 0, cest),
+			Destination:            "Pirbadet via sentrum",
+			IsRealtime:             true,
+		},
+		{
+			Line:                    "3",
+			RegisteredDepartureTime: time.Date(2022, 5, 20, 18, 20, 30, 0, cest),
+			ScheduledDepartureTime:  time.Date(2022, 5, 20, 18, 20, 0, 0, cest),
+			Destination:             "Hallset",
+			Inbound:                 true,
+		},
+		{
+			Line:                   "3",
+			AimedDepartureTime:     time.Date(2022, 5, 20, 18, 30, 0, 0, cest),
+			ScheduledDepartureTime: time.Date(2022, 5, 20, 18, 30, 0, 0, cest),
+			Destination:            "Lohove",
+			IsRealtime:             true,
+			IsCancelled:            true,
+		},
+	}
+	now := time.Date(2022, 5, 20, 18, 15, 0, 0, cest)
+	out, err := xml.Marshal(StopMonitoring("NSR:StopPlace:42098", departures, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<Siri xmlns="http://www.siri.org.uk/siri" version="2.0"><ServiceDelivery>` +
+		`<ResponseTimestamp>2022-05-20T18:15:00+02:00</ResponseTimestamp><ProducerRef>atb</ProducerRef>` +
+		`<StopMonitoringDelivery version="2.0"><ResponseTimestamp>2022-05-20T18:15:00+02:00</ResponseTimestamp>` +
+		`<MonitoredStopVisit><RecordedAtTime>2022-05-20T18:15:00+02:00</RecordedAtTime><MonitoringRef>NSR:StopPlace:42098</MonitoringRef>` +
+		`<MonitoredVehicleJourney><LineRef>ATB:Line:2_21</LineRef><DirectionRef>outbound</DirectionRef><VehicleMode>bus</VehicleMode>` +
+		`<PublishedLineName>21</PublishedLineName><OperatorRef>ATB:Operator:171</OperatorRef><DestinationName>Pirbadet via sentrum</DestinationName>` +
+		`<Monitored>true</Monitored><MonitoredCall><StopPointRef>NSR:Quay:73154</StopPointRef>` +
+		`<AimedDepartureTime>2022-05-20T18:18:00+02:00</AimedDepartureTime><ExpectedDepartureTime>2022-05-20T18:19:00+02:00</ExpectedDepartureTime>` +
+		`</MonitoredCall></MonitoredVehicleJourney></MonitoredStopVisit>` +
+		`<MonitoredStopVisit><RecordedAtTime>2022-05-20T18:15:00+02:00</RecordedAtTime><MonitoringRef>NSR:StopPlace:42098</MonitoringRef>` +
+		`<MonitoredVehicleJourney><LineRef>3</LineRef><DirectionRef>inbound</DirectionRef>` +
+		`<PublishedLineName>3</PublishedLineName><DestinationName>Hallset</DestinationName>` +
+		`<Monitored>false</Monitored><MonitoredCall><ExpectedDepartureTime>2022-05-20T18:20:00+02:00</ExpectedDepartureTime>` +
+		`<ActualDepartureTime>2022-05-20T18:20:30+02:00</ActualDepartureTime></MonitoredCall></MonitoredVehicleJourney></MonitoredStopVisit>` +
+		`<MonitoredStopVisit><RecordedAtTime>2022-05-20T18:15:00+02:00</RecordedAtTime><MonitoringRef>NSR:StopPlace:42098</MonitoringRef>` +
+		`<MonitoredVehicleJourney><LineRef>3</LineRef><DirectionRef>outbound</DirectionRef>` +
+		`<PublishedLineName>3</PublishedLineName><DestinationName>Lohove</DestinationName>` +
+		`<Monitored>true</Monitored><Cancellation>true</Cancellation><MonitoredCall>` +
+		`<AimedDepartureTime>2022-05-20T18:30:00+02:00</AimedDepartureTime><ExpectedDepartureTime>2022-05-20T18:30:00+02:00</ExpectedDepartureTime>` +
+		`<DepartureStatus>cancelled</DepartureStatus></MonitoredCall></MonitoredVehicleJourney></MonitoredStopVisit>` +
+		`</StopMonitoringDelivery></ServiceDelivery></Siri>`
+	if got := string(out); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
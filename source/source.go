@@ -0,0 +1,264 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/mpolden/atb/entur"
+)
+
+// DepartureSource is a source of departures, stops and situations. Stop IDs are the number part of Entur stop place
+// IDs, i.e. 41613 for NSR:StopPlace:41613.
+type DepartureSource interface {
+	// Departures returns at most count upcoming departures from stopID.
+	Departures(ctx context.Context, count, stopID int) ([]entur.Departure, error)
+	// Arrivals returns at most count upcoming arrivals at stopID, including vehicles terminating there.
+	Arrivals(ctx context.Context, count, stopID int) ([]entur.Departure, error)
+	// Stop returns the stop place identified by stopID.
+	Stop(ctx context.Context, stopID int) (entur.Stop, error)
+	// Situations returns the situations currently affecting stopID.
+	Situations(ctx context.Context, stopID int) ([]entur.Situation, error)
+}
+
+// JourneyPlanner plans trips between stops and provides details about service journeys.
+type JourneyPlanner interface {
+	// Trips returns suggested trips from stop fromID to stop toID. If arriveBy is true, the trips arrive before t,
+	// otherwise they depart after t.
+	Trips(ctx context.Context, fromID, toID int, t time.Time, arriveBy bool) ([]entur.Trip, error)
+	// ServiceJourney returns the service journey identified by id. The returned error wraps entur.ErrNotFound if no
+	// such journey exists.
+	ServiceJourney(ctx context.Context, id string) (entur.ServiceJourney, error)
+}
+
+// LineSource provides information about lines.
+type LineSource interface {
+	// Lines returns all lines, without routes.
+	Lines(ctx context.Context) ([]entur.Line, error)
+	// Line returns the line with given public code, including its routes. The returned error wraps
+	// entur.ErrNotFound if no such line exists.
+	Line(ctx context.Context, publicCode string) (entur.Line, error)
+}
+
+// VehicleSource provides vehicle positions.
+type VehicleSource interface {
+	// Vehicles returns the last known positions of all vehicles.
+	Vehicles(ctx context.Context) ([]entur.Vehicle, error)
+}
+
+// Namer is implemented by sources that have a name, which is used when reporting which source answered a request.
+type Namer interface {
+	// Name returns the name of the source, e.g. timetable.
+	Name() string
+}
+
+// Report records how a Composite answered the requests made while serving a request.
+type Report struct {
+	// Source is the name of the source that answered. If any request fell back to a later source, this is the name of
+	// the last such source. Sources not implementing Namer are named by their type.
+	Source string
+	// Err contains the errors of the sources that failed before another source answered, if any.
+	Err error
+}
+
+type reportKey struct{}
+
+// WithReport returns a copy of ctx in which a Composite records into r how it answered requests made with the returned
+// context.
+func WithReport(ctx context.Context, r *Report) context.Context {
+	return context.WithValue(ctx, reportKey{}, r)
+}
+
+func name(s DepartureSource) string {
+	if n, ok := s.(Namer); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", s)
+}
+
+// Composite is a DepartureSource which tries each of its sources in order, until one of them succeeds.
+type Composite struct {
+	// Logger is used to log failing sources. The default logger is used if nil.
+	Logger  *slog.Logger
+	sources []DepartureSource
+}
+
+// NewComposite creates a new composite of sources. Sources are tried in the given order.
+func NewComposite(sources ...DepartureSource) *Composite {
+	return &Composite{sources: sources}
+}
+
+func (c *Composite) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
+
+func try[T any](ctx context.Context, c *Composite, fn func(DepartureSource) (T, error)) (T, error) {
+	var errs []error
+	for i, s := range c.sources {
+		v, err := fn(s)
+		if err == nil {
+			if r, ok := ctx.Value(reportKey{}).(*Report); ok && (r.Source == "" || len(errs) > 0) {
+				// A fallback source is reported even if later requests are answered by the first source
+				r.Source = name(s)
+				r.Err = errors.Join(append([]error{r.Err}, errs...)...)
+			}
+			return v, nil
+		}
+		if i < len(c.sources)-1 {
+			c.logger().WarnContext(ctx, "departure source failed, trying next", "source", name(s), "error", err)
+		}
+		errs = append(errs, err)
+	}
+	var zero T
+	if len(errs) == 0 {
+		return zero, fmt.Errorf("no departure sources configured")
+	}
+	return zero, errors.Join(errs...)
+}
+
+// Departures returns departures from the first source that succeeds.
+func (c *Composite) Departures(ctx context.Context, count, stopID int) ([]entur.Departure, error) {
+	return try(ctx, c, func(s DepartureSource) ([]entur.Departure, error) { return s.Departures(ctx, count, stopID) })
+}
+
+// Arrivals returns arrivals from the first source that succeeds.
+func (c *Composite) Arrivals(ctx context.Context, count, stopID int) ([]entur.Departure, error) {
+	return try(ctx, c, func(s DepartureSource) ([]entur.Departure, error) { return s.Arrivals(ctx, count, stopID) })
+}
+
+// Stop returns the stop from the first source that succeeds.
+func (c *Composite) Stop(ctx context.Context, stopID int) (entur.Stop, error) {
+	return try(ctx, c, func(s DepartureSource) (entur.Stop, error) { return s.Stop(ctx, stopID) })
+}
+
+// Situations returns situations from the first source that succeeds.
+func (c *Composite) Situations(ctx context.Context, stopID int) ([]entur.Situation, error) {
+	return try(ctx, c, func(s DepartureSource) ([]entur.Situation, error) { return s.Situations(ctx, stopID) })
+}
+
+// Fake is an in-memory DepartureSource, intended for testing.
+type Fake struct {
+	StopDepartures map[int][]entur.Departure
+	StopArrivals   map[int][]entur.Departure
+	Stops          map[int]entur.Stop
+	StopSituations map[int][]entur.Situation
+	// StopTrips contains trips keyed by their from and to stop IDs.
+	StopTrips map[[2]int][]entur.Trip
+	// Journeys contains service journeys keyed by their ID.
+	Journeys map[string]entur.ServiceJourney
+	// AllLines contains all known lines.
+	AllLines []entur.Line
+	// AllVehicles contains the positions of all vehicles.
+	AllVehicles []entur.Vehicle
+	// Err is returned from all methods if set.
+	Err error
+}
+
+// Departures returns at most count departures from StopDepartures.
+func (f *Fake) Departures(ctx context.Context, count, stopID int) ([]entur.Departure, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	departures, ok := f.StopDepartures[stopID]
+	if !ok {
+		return nil, fmt.Errorf("stop %d not found", stopID)
+	}
+	if len(departures) > count {
+		departures = departures[:count]
+	}
+	return departures, nil
+}
+
+// Arrivals returns at most count arrivals from StopArrivals.
+func (f *Fake) Arrivals(ctx context.Context, count, stopID int) ([]entur.Departure, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	arrivals, ok := f.StopArrivals[stopID]
+	if !ok {
+		return nil, fmt.Errorf("stop %d not found", stopID)
+	}
+	if len(arrivals) > count {
+		arrivals = arrivals[:count]
+	}
+	return arrivals, nil
+}
+
+// Stop returns the stop from Stops.
+func (f *Fake) Stop(ctx context.Context, stopID int) (entur.Stop, error) {
+	if f.Err != nil {
+		return entur.Stop{}, f.Err
+	}
+	stop, ok := f.Stops[stopID]
+	if !ok {
+		return entur.Stop{}, fmt.Errorf("stop %d %w", stopID, entur.ErrNotFound)
+	}
+	return stop, nil
+}
+
+// Situations returns situations from StopSituations.
+func (f *Fake) Situations(ctx context.Context, stopID int) ([]entur.Situation, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.StopSituations[stopID], nil
+}
+
+// Trips returns trips from StopTrips.
+func (f *Fake) Trips(ctx context.Context, fromID, toID int, t time.Time, arriveBy bool) ([]entur.Trip, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.StopTrips[[2]int{fromID, toID}], nil
+}
+
+// ServiceJourney returns the service journey from Journeys.
+func (f *Fake) ServiceJourney(ctx context.Context, id string) (entur.ServiceJourney, error) {
+	if f.Err != nil {
+		return entur.ServiceJourney{}, f.Err
+	}
+	sj, ok := f.Journeys[id]
+	if !ok {
+		return entur.ServiceJourney{}, fmt.Errorf("service journey %s %w", id, entur.ErrNotFound)
+	}
+	return sj, nil
+}
+
+// Lines returns AllLines without routes.
+func (f *Fake) Lines(ctx context.Context) ([]entur.Line, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	lines := make([]entur.Line, 0, len(f.AllLines))
+	for _, l := range f.AllLines {
+		l.Routes = nil
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
+
+// Line returns the line from AllLines having given public code.
+func (f *Fake) Line(ctx context.Context, publicCode string) (entur.Line, error) {
+	if f.Err != nil {
+		return entur.Line{}, f.Err
+	}
+	for _, l := range f.AllLines {
+		if l.PublicCode == publicCode {
+			return l, nil
+		}
+	}
+	return entur.Line{}, fmt.Errorf("line %s %w", publicCode, entur.ErrNotFound)
+}
+
+// Vehicles returns AllVehicles.
+func (f *Fake) Vehicles(ctx context.Context) ([]entur.Vehicle, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.AllVehicles, nil
+}
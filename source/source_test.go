@@ -0,0 +1,120 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/mpolden/atb/entur"
+	"github.com/mpolden/atb/timetable"
+)
+
+// Assert that all implementations satisfy the interface
+var (
+	_ DepartureSource = &entur.Client{}
+	_ DepartureSource = &timetable.Timetable{}
+	_ DepartureSource = &Composite{}
+	_ DepartureSource = &Fake{}
+	_ JourneyPlanner  = &entur.Client{}
+	_ JourneyPlanner  = &Fake{}
+	_ LineSource      = &entur.Client{}
+	_ LineSource      = &Fake{}
+	_ VehicleSource   = &entur.Client{}
+	_ VehicleSource   = &Fake{}
+)
+
+func TestComposite(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	ctx := context.Background()
+	failing := &Fake{Err: errors.New("unavailable")}
+	primary := &Fake{
+		StopDepartures: map[int][]entur.Departure{1: {{Line: "3"}, {Line: "21"}}},
+		Stops:          map[int]entur.Stop{1: {Name: "Prinsens gate"}},
+		StopSituations: map[int][]entur.Situation{1: {{ID: "s1"}}},
+	}
+	secondary := &Fake{
+		StopDepartures: map[int][]entur.Departure{1: {{Line: "71"}}, 2: {{Line: "11"}}},
+		Stops:          map[int]entur.Stop{2: {Name: "Ilsvika"}},
+	}
+	var tests = []struct {
+		sources []DepartureSource
+		stopID  int
+		line    string
+		stop    string
+		err     string
+	}{
+		{[]DepartureSource{primary, secondary}, 1, "3", "Prinsens gate", ""},
+		{[]DepartureSource{failing, primary}, 1, "3", "Prinsens gate", ""},
+		{[]DepartureSource{primary, secondary}, 2, "11", "Ilsvika", ""},
+		{[]DepartureSource{failing, primary}, 2, "", "", "unavailable\nstop 2 not found"},
+		{nil, 1, "", "", "no departure sources configured"},
+	}
+	for i, tt := range tests {
+		c := NewComposite(tt.sources...)
+		departures, err := c.Departures(ctx, 1, tt.stopID)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("#%d: want error %q, got %q", i, tt.err, got)
+		}
+		if tt.err != "" {
+			continue
+		}
+		if len(departures) != 1 || departures[0].Line != tt.line {
+			t.Errorf("#%d: want line %s, got %+v", i, tt.line, departures)
+		}
+		stop, err := c.Stop(ctx, tt.stopID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stop.Name != tt.stop {
+			t.Errorf("#%d: want stop %q, got %q", i, tt.stop, stop.Name)
+		}
+	}
+	situations, err := NewComposite(failing, primary).Situations(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(situations) != 1 || situations[0].ID != "s1" {
+		t.Errorf("want situation s1, got %+v", situations)
+	}
+}
+
+func TestCompositeReport(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	failing := &Fake{Err: errors.New("unavailable")}
+	primary := &Fake{StopDepartures: map[int][]entur.Departure{1: {{Line: "3"}}}}
+	var tests = []struct {
+		sources []DepartureSource
+		calls   int
+		source  string
+		err     string
+	}{
+		{[]DepartureSource{primary}, 1, "*source.Fake", ""},
+		{[]DepartureSource{failing, primary}, 1, "*source.Fake", "unavailable"},
+		{[]DepartureSource{failing, primary}, 2, "*source.Fake", "unavailable\nunavailable"},
+		{[]DepartureSource{failing}, 1, "", ""},
+	}
+	for i, tt := range tests {
+		var report Report
+		ctx := WithReport(context.Background(), &report)
+		c := NewComposite(tt.sources...)
+		for j := 0; j < tt.calls; j++ {
+			c.Departures(ctx, 1, 1)
+		}
+		if report.Source != tt.source {
+			t.Errorf("#%d: want source %q, got %q", i, tt.source, report.Source)
+		}
+		got := ""
+		if report.Err != nil {
+			got = report.Err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("#%d: want error %q, got %q", i, tt.err, got)
+		}
+	}
+}
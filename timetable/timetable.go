@@ -0,0 +1,461 @@
+package timetable
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // GTFS feeds name their time zone, which may not be available on the host
+
+	"github.com/mpolden/atb/entur"
+)
+
+// Timetable is an index of scheduled departures read from a static GTFS feed. See
+// https://gtfs.org/schedule/reference/ for a description of the format.
+type Timetable struct {
+	now       func() time.Time
+	location  *time.Location
+	stops     map[string]*entur.Stop
+	routes    map[string]*route
+	trips     map[string]*trip
+	services  map[string]*service
+	stopTimes map[string][]stopTime // Keyed on stop place
+}
+
+type route struct {
+	id        string
+	agencyID  string
+	shortName string
+	mode      string
+}
+
+type trip struct {
+	id        string
+	route     *route
+	serviceID string
+	headsign  string
+	inbound   bool
+}
+
+type service struct {
+	weekdays   [7]bool
+	start, end string // YYYYMMDD
+	added      map[string]bool
+	removed    map[string]bool
+}
+
+type stopTime struct {
+	trip      *trip
+	stopID    string
+	arrival   int // Seconds since noon minus 12h, may exceed 24h
+	departure int
+	headsign  string
+}
+
+// ReadFile reads a GTFS feed from name, which is either a zip file or a directory containing the feed files.
+func ReadFile(name string) (*Timetable, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return Read(os.DirFS(name))
+	}
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return Read(r)
+}
+
+// Read reads a GTFS feed from fsys.
+func Read(fsys fs.FS) (*Timetable, error) {
+	t := &Timetable{
+		now:       time.Now,
+		stops:     make(map[string]*entur.Stop),
+		routes:    make(map[string]*route),
+		trips:     make(map[string]*trip),
+		services:  make(map[string]*service),
+		stopTimes: make(map[string][]stopTime),
+	}
+	parents := make(map[string]string)
+	var quays []quay
+	readers := []struct {
+		name     string
+		optional bool
+		fn       func(record) error
+	}{
+		{"agency.txt", false, t.readAgency},
+		{"stops.txt", false, func(r record) error { return t.readStop(r, parents, &quays) }},
+		{"routes.txt", false, t.readRoute},
+		{"trips.txt", false, t.readTrip},
+		{"calendar.txt", true, t.readCalendar},
+		{"calendar_dates.txt", true, t.readCalendarDate},
+		{"stop_times.txt", false, func(r record) error { return t.readStopTime(r, parents) }},
+	}
+	for _, rd := range readers {
+		err := readCSV(fsys, rd.name, rd.fn)
+		if rd.optional && errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.location == nil {
+		return nil, fmt.Errorf("agency.txt: no agency found")
+	}
+	for _, q := range quays {
+		if stop, ok := t.stops[q.parent]; ok {
+			stop.Quays = append(stop.Quays, q.Quay)
+		}
+	}
+	for _, stopTimes := range t.stopTimes {
+		sort.Slice(stopTimes, func(i, j int) bool { return stopTimes[i].departure < stopTimes[j].departure })
+	}
+	return t, nil
+}
+
+// record is a row in a GTFS file, with fields accessed by column name.
+type record struct {
+	columns map[string]int
+	fields  []string
+}
+
+func (r record) get(column string) string {
+	if i, ok := r.columns[column]; ok && i < len(r.fields) {
+		return r.fields[i]
+	}
+	return ""
+}
+
+func readCSV(fsys fs.FS, name string, fn func(record) error) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		columns[strings.TrimPrefix(strings.TrimSpace(column), "\ufeff")] = i
+	}
+	for line := 2; ; line++ {
+		fields, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := fn(record{columns: columns, fields: fields}); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+}
+
+func (t *Timetable) readAgency(r record) error {
+	if t.location != nil {
+		return nil // All agencies in a feed must have the same time zone
+	}
+	location, err := time.LoadLocation(r.get("agency_timezone"))
+	if err != nil {
+		return err
+	}
+	t.location = location
+	return nil
+}
+
+type quay struct {
+	entur.Quay
+	parent string
+}
+
+func (t *Timetable) readStop(r record, parents map[string]string, quays *[]quay) error {
+	id := r.get("stop_id")
+	name := r.get("stop_name")
+	latitude, _ := strconv.ParseFloat(r.get("stop_lat"), 64)
+	longitude, _ := strconv.ParseFloat(r.get("stop_lon"), 64)
+	switch r.get("location_type") {
+	case "", "0":
+		parent := r.get("parent_station")
+		if parent == "" {
+			break
+		}
+		parents[id] = parent
+		*quays = append(*quays, quay{
+			Quay: entur.Quay{
+				ID:         id,
+				Name:       name,
+				PublicCode: r.get("platform_code"),
+				Latitude:   latitude,
+				Longitude:  longitude,
+			},
+			parent: parent,
+		})
+	case "1":
+		t.stops[id] = &entur.Stop{ID: id, Name: name, Latitude: latitude, Longitude: longitude}
+	}
+	return nil
+}
+
+// transportMode converts a GTFS route type to an Entur transport mode.
+func transportMode(routeType string) string {
+	n, err := strconv.Atoi(routeType)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case n == 0 || n >= 900 && n < 1000:
+		return "tram"
+	case n == 1 || n >= 400 && n < 500:
+		return "metro"
+	case n == 2 || n >= 100 && n < 200:
+		return "rail"
+	case n == 3 || n >= 700 && n < 800:
+		return "bus"
+	case n == 4 || n >= 1000 && n < 1300:
+		return "water"
+	case n == 6 || n >= 1300 && n < 1400:
+		return "lift"
+	case n == 11 || n >= 800 && n < 900:
+		return "trolleybus"
+	case n >= 200 && n < 300:
+		return "coach"
+	}
+	return ""
+}
+
+func (t *Timetable) readRoute(r record) error {
+	id := r.get("route_id")
+	t.routes[id] = &route{
+		id:        id,
+		agencyID:  r.get("agency_id"),
+		shortName: r.get("route_short_name"),
+		mode:      transportMode(r.get("route_type")),
+	}
+	return nil
+}
+
+func (t *Timetable) readTrip(r record) error {
+	route, ok := t.routes[r.get("route_id")]
+	if !ok {
+		return fmt.Errorf("unknown route: %q", r.get("route_id"))
+	}
+	id := r.get("trip_id")
+	t.trips[id] = &trip{
+		id:        id,
+		route:     route,
+		serviceID: r.get("service_id"),
+		headsign:  r.get("trip_headsign"),
+		inbound:   r.get("direction_id") == "1",
+	}
+	return nil
+}
+
+func (t *Timetable) service(id string) *service {
+	s, ok := t.services[id]
+	if !ok {
+		s = &service{added: make(map[string]bool), removed: make(map[string]bool)}
+		t.services[id] = s
+	}
+	return s
+}
+
+func (t *Timetable) readCalendar(r record) error {
+	s := t.service(r.get("service_id"))
+	// Ordered according to time.Weekday
+	days := []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+	for i, day := range days {
+		s.weekdays[i] = r.get(day) == "1"
+	}
+	s.start = r.get("start_date")
+	s.end = r.get("end_date")
+	return nil
+}
+
+func (t *Timetable) readCalendarDate(r record) error {
+	s := t.service(r.get("service_id"))
+	date := r.get("date")
+	switch r.get("exception_type") {
+	case "1":
+		s.added[date] = true
+	case "2":
+		s.removed[date] = true
+	default:
+		return fmt.Errorf("invalid exception_type: %q", r.get("exception_type"))
+	}
+	return nil
+}
+
+func parseTime(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	seconds := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return 0, fmt.Errorf("invalid time: %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+func (t *Timetable) readStopTime(r record, parents map[string]string) error {
+	trip, ok := t.trips[r.get("trip_id")]
+	if !ok {
+		return fmt.Errorf("unknown trip: %q", r.get("trip_id"))
+	}
+	arrivalTime := r.get("arrival_time")
+	departureTime := r.get("departure_time")
+	if departureTime == "" {
+		departureTime = arrivalTime
+	}
+	if arrivalTime == "" {
+		arrivalTime = departureTime
+	}
+	if departureTime == "" {
+		return nil // Untimed stop
+	}
+	departure, err := parseTime(departureTime)
+	if err != nil {
+		return err
+	}
+	arrival, err := parseTime(arrivalTime)
+	if err != nil {
+		return err
+	}
+	stopID := r.get("stop_id")
+	stopPlace := stopID
+	if parent, ok := parents[stopID]; ok {
+		stopPlace = parent
+	}
+	t.stopTimes[stopPlace] = append(t.stopTimes[stopPlace], stopTime{
+		trip:      trip,
+		stopID:    stopID,
+		arrival:   arrival,
+		departure: departure,
+		headsign:  r.get("stop_headsign"),
+	})
+	return nil
+}
+
+func (s *service) activeOn(date time.Time) bool {
+	if s == nil {
+		return false
+	}
+	d := date.Format("20060102")
+	if s.removed[d] {
+		return false
+	}
+	if s.added[d] {
+		return true
+	}
+	return s.weekdays[date.Weekday()] && d >= s.start && d <= s.end
+}
+
+func stopPlaceID(stopID int) string { return fmt.Sprintf("NSR:StopPlace:%d", stopID) }
+
+// Name returns the name of this departure source.
+func (t *Timetable) Name() string { return "timetable" }
+
+// Stop returns the stop place identified by stopID. Stop IDs are the number part of Entur stop place IDs, i.e. 41613
+// for NSR:StopPlace:41613.
+func (t *Timetable) Stop(ctx context.Context, stopID int) (entur.Stop, error) {
+	stop, ok := t.stops[stopPlaceID(stopID)]
+	if !ok {
+		return entur.Stop{}, fmt.Errorf("stop %d %w in timetable", stopID, entur.ErrNotFound)
+	}
+	return *stop, nil
+}
+
+// Situations returns the situations affecting the stop place identified by stopID. A static timetable contains no
+// situations, so this always returns an empty list.
+func (t *Timetable) Situations(ctx context.Context, stopID int) ([]entur.Situation, error) {
+	return nil, nil
+}
+
+// Departures returns at most count scheduled departures from the given stop ID, departing from now on. Stop IDs are
+// the number part of Entur stop place IDs, i.e. 41613 for NSR:StopPlace:41613.
+func (t *Timetable) Departures(ctx context.Context, count, stopID int) ([]entur.Departure, error) {
+	return t.calls(count, stopID, false)
+}
+
+// Arrivals returns at most count scheduled arrivals at the given stop ID, arriving from now on.
+func (t *Timetable) Arrivals(ctx context.Context, count, stopID int) ([]entur.Departure, error) {
+	return t.calls(count, stopID, true)
+}
+
+func (t *Timetable) calls(count, stopID int, arrivals bool) ([]entur.Departure, error) {
+	stopTimes, ok := t.stopTimes[stopPlaceID(stopID)]
+	if !ok {
+		return nil, fmt.Errorf("stop %d not found in timetable", stopID)
+	}
+	now := t.now().In(t.location)
+	var departures []entur.Departure
+	// Trips from the previous service day may depart after midnight
+	for offset := -1; offset <= 1; offset++ {
+		date := time.Date(now.Year(), now.Month(), now.Day()+offset, 0, 0, 0, 0, t.location)
+		// GTFS times are relative to noon minus 12h, which differs from midnight on days with DST transitions
+		noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, t.location)
+		start := noon.Add(-12 * time.Hour)
+		for _, st := range stopTimes {
+			arrival := start.Add(time.Duration(st.arrival) * time.Second)
+			departure := start.Add(time.Duration(st.departure) * time.Second)
+			if (arrivals && arrival.Before(now)) || (!arrivals && departure.Before(now)) {
+				continue
+			}
+			if !t.services[st.trip.serviceID].activeOn(date) {
+				continue
+			}
+			destination := st.headsign
+			if destination == "" {
+				destination = st.trip.headsign
+			}
+			departures = append(departures, entur.Departure{
+				Line:                   st.trip.route.shortName,
+				LineID:                 st.trip.route.id,
+				ServiceJourneyID:       st.trip.id,
+				TransportMode:          st.trip.route.mode,
+				Operator:               st.trip.route.agencyID,
+				Quay:                   st.stopID,
+				AimedArrivalTime:       arrival,
+				ExpectedArrivalTime:    arrival,
+				AimedDepartureTime:     departure,
+				ScheduledDepartureTime: departure,
+				Destination:            destination,
+				IsRealtime:             false,
+				Inbound:                st.trip.inbound,
+				Timetable:              true,
+			})
+		}
+	}
+	sort.SliceStable(departures, func(i, j int) bool {
+		if arrivals {
+			return departures[i].ExpectedArrivalTime.Before(departures[j].ExpectedArrivalTime)
+		}
+		return departures[i].ScheduledDepartureTime.Before(departures[j].ScheduledDepartureTime)
+	})
+	if len(departures) > count {
+		departures = departures[:count]
+	}
+	return departures, nil
+}
@@ -0,0 +1,199 @@
+package timetable
+
+import (
+	"archive/zip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mpolden/atb/entur"
+)
+
+func TestDepartures(t *testing.T) {
+	tab, err := ReadFile(filepath.Join("testdata", "gtfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type departure struct {
+		serviceJourney string
+		departureTime  time.Time
+	}
+	var tests = []struct {
+		stopID int
+		count  int
+		now    time.Time
+		out    []departure
+	}{
+		{41613, 3, time.Date(2022, 5, 20, 23, 30, 0, 0, oslo), []departure{
+			{"ATB:ServiceJourney:3_1", time.Date(2022, 5, 20, 23, 40, 0, 0, oslo)},
+			{"ATB:ServiceJourney:3_2", time.Date(2022, 5, 20, 23, 55, 0, 0, oslo)},
+			{"ATB:ServiceJourney:3_3", time.Date(2022, 5, 21, 0, 10, 0, 0, oslo)},
+		}},
+		{41613, 10, time.Date(2022, 5, 20, 23, 30, 0, 0, oslo), []departure{
+			{"ATB:ServiceJourney:3_1", time.Date(2022, 5, 20, 23, 40, 0, 0, oslo)},
+			{"ATB:ServiceJourney:3_2", time.Date(2022, 5, 20, 23, 55, 0, 0, oslo)},
+			{"ATB:ServiceJourney:3_3", time.Date(2022, 5, 21, 0, 10, 0, 0, oslo)},
+			{"ATB:ServiceJourney:21_1", time.Date(2022, 5, 21, 0, 30, 0, 0, oslo)},
+		}},
+		// Calendar exceptions
+		{41613, 10, time.Date(2022, 5, 28, 0, 0, 0, 0, oslo), []departure{
+			{"ATB:ServiceJourney:3_3", time.Date(2022, 5, 28, 0, 10, 0, 0, oslo)},
+			{"ATB:ServiceJourney:21_2", time.Date(2022, 5, 28, 0, 25, 0, 0, oslo)},
+			{"ATB:ServiceJourney:21_1", time.Date(2022, 5, 29, 0, 30, 0, 0, oslo)},
+		}},
+		{41613, 10, time.Date(2022, 5, 17, 23, 0, 0, 0, oslo), []departure{
+			{"ATB:ServiceJourney:3_1", time.Date(2022, 5, 18, 23, 40, 0, 0, oslo)},
+			{"ATB:ServiceJourney:3_2", time.Date(2022, 5, 18, 23, 55, 0, 0, oslo)},
+			{"ATB:ServiceJourney:3_3", time.Date(2022, 5, 19, 0, 10, 0, 0, oslo)},
+		}},
+		// Time in another zone
+		{42098, 10, time.Date(2022, 5, 20, 21, 50, 0, 0, time.UTC), []departure{
+			{"ATB:ServiceJourney:3_1", time.Date(2022, 5, 20, 23, 55, 0, 0, oslo)},
+			{"ATB:ServiceJourney:21_1", time.Date(2022, 5, 21, 0, 20, 0, 0, oslo)},
+		}},
+	}
+	for i, tt := range tests {
+		tab.now = func() time.Time { return tt.now }
+		departures, err := tab.Departures(context.Background(), tt.count, tt.stopID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(departures) != len(tt.out) {
+			t.Errorf("#%d: want %d departures, got %d", i, len(tt.out), len(departures))
+			continue
+		}
+		for j, d := range departures {
+			want := tt.out[j]
+			if d.ServiceJourneyID != want.serviceJourney || !d.ScheduledDepartureTime.Equal(want.departureTime) {
+				t.Errorf("#%d: want departure %d = (%s, %s), got (%s, %s)", i, j, want.serviceJourney, want.departureTime, d.ServiceJourneyID, d.ScheduledDepartureTime)
+			}
+			if d.IsRealtime {
+				t.Errorf("#%d: want IsRealtime = false for departure %d", i, j)
+			}
+		}
+	}
+	tab.now = func() time.Time { return time.Date(2022, 5, 20, 23, 50, 0, 0, oslo) }
+	departures, err := tab.Departures(context.Background(), 1, 41613)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := departures[0]
+	if d.Line != "3" || d.LineID != "ATB:Line:2_3" || d.TransportMode != "bus" || d.Quay != "NSR:Quay:71181" ||
+		d.Destination != "Lohove via sentrum" || d.Inbound || !d.AimedDepartureTime.Equal(d.ScheduledDepartureTime) {
+		t.Errorf("got unexpected departure %+v", d)
+	}
+	if _, err := tab.Departures(context.Background(), 1, 42); err == nil {
+		t.Error("want error for unknown stop")
+	}
+}
+
+func TestArrivals(t *testing.T) {
+	tab, err := ReadFile(filepath.Join("testdata", "gtfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab.now = func() time.Time { return time.Date(2022, 5, 20, 23, 54, 30, 0, oslo) }
+	departures, err := tab.Departures(context.Background(), 5, 42098)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrivals, err := tab.Arrivals(context.Background(), 5, 42098)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3_1 arrives before now, but has not departed yet
+	if len(departures) == 0 || departures[0].ServiceJourneyID != "ATB:ServiceJourney:3_1" {
+		t.Errorf("want first departure ATB:ServiceJourney:3_1, got %+v", departures)
+	}
+	if len(arrivals) == 0 || arrivals[0].ServiceJourneyID != "ATB:ServiceJourney:21_1" {
+		t.Errorf("want first arrival ATB:ServiceJourney:21_1, got %+v", arrivals)
+	}
+	tab.now = func() time.Time { return time.Date(2022, 5, 20, 23, 50, 0, 0, oslo) }
+	arrivals, err = tab.Arrivals(context.Background(), 1, 42098)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2022, 5, 20, 23, 54, 0, 0, oslo)
+	if len(arrivals) != 1 || !arrivals[0].ExpectedArrivalTime.Equal(want) || !arrivals[0].AimedArrivalTime.Equal(want) {
+		t.Errorf("want arrival at %s, got %+v", want, arrivals)
+	}
+}
+
+func TestStop(t *testing.T) {
+	tab, err := ReadFile(filepath.Join("testdata", "gtfs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tab.Stop(context.Background(), 41613)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := entur.Stop{
+		ID:        "NSR:StopPlace:41613",
+		Name:      "Prinsens gate",
+		Latitude:  63.431034,
+		Longitude: 10.392086,
+		Quays: []entur.Quay{
+			{ID: "NSR:Quay:71184", Name: "Prinsens gate", Latitude: 63.431099, Longitude: 10.391986},
+			{ID: "NSR:Quay:71181", Name: "Prinsens gate", Latitude: 63.430969, Longitude: 10.392186},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := tab.Stop(context.Background(), 42); err == nil {
+		t.Error("want error for unknown stop")
+	}
+}
+
+func TestReadZip(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "gtfs.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	files, err := filepath.Glob(filepath.Join("testdata", "gtfs", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := w.Create(filepath.Base(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tab, err := ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tab.stopTimes), 2; got != want {
+		t.Errorf("want %d stop places, got %d", want, got)
+	}
+}